@@ -9,6 +9,8 @@ import (
     "github.com/maxmanuylov/jongleur/jongleur/etcd"
     "github.com/maxmanuylov/jongleur/jongleur/regular"
     "github.com/maxmanuylov/jongleur/utils"
+    "github.com/maxmanuylov/jongleur/utils/cycle"
+    "github.com/maxmanuylov/jongleur/utils/etcd"
     "log"
     "os"
 )
@@ -41,7 +43,7 @@ func Run() {
 }
 
 func runItem(args []string) {
-    config := &item.Config{Health:&item.StringHolder{}}
+    config := &item.Config{Health:&utils.StringHolder{}, Weight:&utils.IntHolder{}, Zone:&utils.StringHolder{}, Priority:&utils.IntHolder{}, ServerName:&utils.StringHolder{}}
 
     flagSet := itemFlagSet(config)
     flagSet.Parse(args)
@@ -52,7 +54,7 @@ func runItem(args []string) {
 }
 
 func runEtcdProxy(args []string) {
-    config := &etcd.Config{}
+    config := &etcd.Config{Options: jongleur.DefaultOptions()}
 
     flagSet := etcdFlagSet(config)
     flagSet.Parse(args)
@@ -68,7 +70,7 @@ func runEtcdProxy(args []string) {
 }
 
 func runCephMonProxy(args []string) {
-    config := &ceph.Config{}
+    config := &ceph.Config{Config: *newRegularConfig()}
 
     flagSet := cephFlagSet(config)
     flagSet.Parse(args)
@@ -84,29 +86,44 @@ func runCephMonProxy(args []string) {
 }
 
 func runJongleur(args []string) {
-    config := &regular.Config{}
+    config := newRegularConfig()
 
     flagSet := jongleurFlagSet(config)
     flagSet.Parse(args)
 
-    jongleurConfig, err := config.ToJongleurConfig()
+    jongleurConfigs, err := config.ToJongleurConfigs()
     if err != nil {
         printErrorAndExit(err, jongleurName, flagSet)
     }
 
-    if err := jongleur.Run(jongleurConfig, newLogger()); err != nil {
+    if err := jongleur.RunGroup(jongleurConfigs, newLogger()); err != nil {
         printErrorAndExit(err, jongleurName, flagSet)
     }
 }
 
+func newRegularConfig() *regular.Config {
+    return &regular.Config{
+        Items: &utils.StringHolder{},
+        Listen: &utils.StringHolder{},
+        Routes: &regular.RepeatedFlag{},
+        RoutesFile: &utils.StringHolder{},
+        SNIRoutes: &regular.RepeatedFlag{},
+        Options: jongleur.DefaultOptions(),
+    }
+}
+
 func itemFlagSet(config *item.Config) *flag.FlagSet {
     flagSet := flag.NewFlagSet(jongleurItemName, flag.ExitOnError)
 
     flagSet.Usage = usageFunc(jongleurItemName, flagSet)
 
     flagSet.StringVar(&config.Type, "type", "", "service type; must be the same for all instances of the same service (required)")
-    flagSet.StringVar(&config.Host, "host", "", "advertised host; use \"<ip>:<port>\" format to advertise the specified port and \"<ip>:*\" format to advertise all the ports (request destination port is used in this case); service must be available from the network by this host (required)")
+    flagSet.StringVar(&config.Host, "host", "", "advertised host; use \"<ip>:<port>\" (\"[<ipv6>]:<port>\" for IPv6) format to advertise the specified port and \"<ip>:*\" format to advertise all the ports (request destination port is used in this case) and \"unix@<socket path>\" format to advertise a unix socket available to the proxies on the same machine; service must be available from the network by this host (required)")
     flagSet.StringVar(&config.Health.Value, "health", "", "service health checking HTTP URL; response code 2xx is expected to treat service healthy; if not specified heath check is disabled")
+    flagSet.IntVar(&config.Weight.Value, "weight", etcd_utils.DefaultItemWeight, "relative share of new connections the instance gets; zero weight keeps the instance registered but gives it no new connections")
+    flagSet.StringVar(&config.Zone.Value, "zone", "", "zone (rack, data center, etc.) the service instance runs in; proxies of the same zone prefer such instances")
+    flagSet.StringVar(&config.ServerName.Value, "server-name", "", "TLS server name of the service instance; proxies connecting over TLS send and verify it instead of the default one")
+    flagSet.IntVar(&config.Priority.Value, "priority", 0, "priority group of the service instance; lower value means higher priority; instances get traffic only if there are no live instances with higher priority")
     flagSet.IntVar(&config.Period, "period", 5, "health check period in seconds")
     flagSet.IntVar(&config.Tolerance, "tolerance", 3, "number of allowed sequential health check failures to not treat the service as dead")
     flagSet.StringVar(&config.Etcd, "etcd", "http://127.0.0.1:2379", "etcd URL")
@@ -124,6 +141,8 @@ func etcdFlagSet(config *etcd.Config) *flag.FlagSet {
     flagSet.IntVar(&config.Period, "period", 10, "service instances list synchronization period in seconds")
     flagSet.StringVar(&config.Discovery, "discovery", "", "etcd discovery URL (required)")
 
+    appendOptionsFlags(config.Options, flagSet)
+
     return flagSet
 }
 
@@ -144,16 +163,68 @@ func jongleurFlagSet(config *regular.Config) *flag.FlagSet {
 
     appendJongleurFlags(config, flagSet)
 
+    flagSet.Var(config.Routes, "route", "\"<listen>=<items>\" additional route in the same format as \"listen\" and \"items\" options; can be repeated; all the routes share one etcd client and one synchronization loop")
+    flagSet.StringVar(&config.RoutesFile.Value, "routes-file", "", "file with \"<listen>=<items>\" additional route per line; empty lines and lines starting with \"#\" are ignored")
+    flagSet.Var(config.SNIRoutes, "sni-route", "\"<server name>=<items>\" route of TLS connections by the server name in ClientHello; server name can be \"*.<domain>\" to match any subdomain; can be repeated; connections not matching any route go to \"items\"")
+
     return flagSet
 }
 
 func appendJongleurFlags(config *regular.Config, flagSet *flag.FlagSet) {
     flagSet.BoolVar(&config.Verbose, "verbose", false, "flag to enable verbose output")
-    flagSet.StringVar(&config.Items, "items", "", "type of the service to proxy (required)")
-    flagSet.StringVar(&config.Listen, "listen", "", "listen address in form \"[<network>@]address\"; network can be \"tcp\" or \"unix\"; default network is \"tcp\" (required)")
+    flagSet.StringVar(&config.Items.Value, "items", "", "type of the service to proxy (required)")
+    flagSet.StringVar(&config.Listen.Value, "listen", "", "listen address in form \"[<network>@]address\"; network can be \"tcp\", \"udp\" or \"unix\"; default network is \"tcp\"; \"tcp\" and \"udp\" listen on both IPv4 and IPv6 unless the address is of one of them, \"tcp4\", \"tcp6\", \"udp4\" and \"udp6\" restrict the family (required)")
     flagSet.IntVar(&config.RemotePort, "remote-port", -1, "remote port to transfer requests to in case of using \"*\" for item ports; by default items with \"*\" ports are ignored")
+    flagSet.BoolVar(&config.Options.Transparent, "transparent", false, "transparent mode for the connections redirected to the proxy by iptables REDIRECT or TPROXY (TPROXY requires CAP_NET_ADMIN): items with \"*\" ports get the connections on their original destination port (Linux only)")
     flagSet.IntVar(&config.Period, "period", 10, "service instances list synchronization period in seconds")
     flagSet.StringVar(&config.Etcd, "etcd", "http://127.0.0.1:2379", "etcd URL")
+
+    appendOptionsFlags(config.Options, flagSet)
+}
+
+func appendOptionsFlags(options *jongleur.Options, flagSet *flag.FlagSet) {
+    flagSet.StringVar(&options.Balance, "balance", options.Balance, fmt.Sprintf("balancing strategy: \"%s\" (weighted round-robin), \"%s\" (fewest active connections relative to weight), \"%s\" (consistent hashing of client IP for sticky sessions) or \"%s\" (less loaded of two random endpoints judging by dial time and active connections)", cycle.RoundRobin, cycle.LeastConn, cycle.Hash, cycle.P2C))
+    flagSet.IntVar(&options.EjectFailures, "eject-failures", options.EjectFailures, "number of sequential connection failures to temporarily eject the endpoint after; 0 disables ejection")
+    flagSet.IntVar(&options.EjectTime, "eject-time", options.EjectTime, "first ejection time in seconds; it doubles for every next ejection of the same endpoint in a row")
+    flagSet.IntVar(&options.MaxEjectPercent, "max-eject-percent", options.MaxEjectPercent, "maximum percentage of the endpoints that can be ejected at the same time")
+    flagSet.IntVar(&options.ProbeInterval, "probe-interval", options.ProbeInterval, "endpoints active health check period in seconds; endpoint is probed by TCP connection; 0 disables active health checks")
+    flagSet.IntVar(&options.ProbeTimeout, "probe-timeout", options.ProbeTimeout, "endpoint probe timeout in seconds")
+    flagSet.StringVar(&options.ProbeSend, "probe-send", options.ProbeSend, "data to send to the endpoint on probe; Go escape sequences like \"\\r\\n\" are supported")
+    flagSet.StringVar(&options.ProbeExpect, "probe-expect", options.ProbeExpect, "data the endpoint response must start with to treat probe successful; Go escape sequences are supported")
+    flagSet.IntVar(&options.ProbeRise, "probe-rise", options.ProbeRise, "number of sequential successful probes to treat the endpoint up again")
+    flagSet.IntVar(&options.ProbeFall, "probe-fall", options.ProbeFall, "number of sequential failed probes to treat the endpoint down")
+    flagSet.StringVar(&options.Zone, "zone", options.Zone, "zone the proxy runs in; endpoints of this zone are preferred while enough of them are available; by default zones are ignored")
+    flagSet.IntVar(&options.ZoneMinHealthy, "zone-min-healthy", options.ZoneMinHealthy, "minimum percentage of the same zone endpoints that must be available to keep routing to the proxy zone only")
+    flagSet.IntVar(&options.SlowStart, "slow-start", options.SlowStart, "time in seconds for the share of a newly registered endpoint to grow linearly from almost zero to normal; 0 disables slow start")
+    flagSet.IntVar(&options.ConnectAttempts, "connect-attempts", options.ConnectAttempts, "maximum number of endpoint connection attempts per client connection; endpoints that failed are not retried while there are untried ones")
+    flagSet.IntVar(&options.ConnectTimeout, "connect-timeout", options.ConnectTimeout, "endpoint connection attempt timeout in milliseconds")
+    flagSet.IntVar(&options.ConnectDeadline, "connect-deadline", options.ConnectDeadline, "total time in milliseconds for all the connection attempts of a client connection; 0 means no limit")
+    flagSet.IntVar(&options.RetryBackoff, "retry-backoff", options.RetryBackoff, "delay in milliseconds before the first connection retry; it doubles for every next retry; 0 means no delay")
+    flagSet.IntVar(&options.IdleTimeout, "idle-timeout", options.IdleTimeout, "time in seconds without data transferred in either direction to close the connection after; 0 means no limit")
+    flagSet.IntVar(&options.MaxConnLifetime, "max-conn-lifetime", options.MaxConnLifetime, "time in seconds to close the connection after regardless of its activity, so that long-lived clients rebalance; 0 means no limit")
+    flagSet.IntVar(&options.MaxConns, "max-conns", options.MaxConns, "maximum number of client connections served at the same time by all the routes together; 0 means no limit")
+    flagSet.IntVar(&options.MaxConnsPerEndpoint, "max-conns-per-endpoint", options.MaxConnsPerEndpoint, "maximum number of connections to a single endpoint; other endpoints are picked when the limit is reached; 0 means no limit")
+    flagSet.IntVar(&options.QueueSize, "queue-size", options.QueueSize, "maximum number of client connections waiting for a free slot when the connection limits are reached; connections exceeding it are rejected")
+    flagSet.IntVar(&options.QueueTimeout, "queue-timeout", options.QueueTimeout, "time in milliseconds a client connection can wait for a free slot before it is rejected")
+    flagSet.IntVar(&options.ClientRate, "client-rate", options.ClientRate, "maximum number of new connections per second from a single client address; 0 means no limit")
+    flagSet.IntVar(&options.ClientBurst, "client-burst", options.ClientBurst, "number of new connections a single client address can open at once before the rate limit applies")
+    flagSet.IntVar(&options.ClientMaxConns, "client-max-conns", options.ClientMaxConns, "maximum number of concurrent connections from a single client address; 0 means no limit")
+    flagSet.IntVar(&options.ClientPrefix4, "client-prefix-v4", options.ClientPrefix4, "IPv4 client addresses are grouped by the prefix of this length to apply the per client limits")
+    flagSet.IntVar(&options.ClientPrefix6, "client-prefix-v6", options.ClientPrefix6, "IPv6 client addresses are grouped by the prefix of this length to apply the per client limits")
+    flagSet.StringVar(&options.SendProxy, "send-proxy", options.SendProxy, "PROXY protocol version (v1 or v2) to send the client address to the endpoints with; empty value disables it")
+    flagSet.BoolVar(&options.AcceptProxy, "accept-proxy", options.AcceptProxy, "expect PROXY protocol (v1 or v2) header on client connections and use the client address from it")
+    flagSet.StringVar(&options.ProxyTrusted, "proxy-trusted", options.ProxyTrusted, "comma separated list of CIDRs PROXY protocol headers are trusted from; empty value trusts all the sources")
+    flagSet.StringVar(&options.TLSCert, "tls-cert", options.TLSCert, "PEM certificate file to terminate TLS on the listener with; it is reloaded when changed")
+    flagSet.StringVar(&options.TLSKey, "tls-key", options.TLSKey, "PEM private key file for the TLS certificate; it is reloaded when changed")
+    flagSet.StringVar(&options.TLSClientCA, "tls-client-ca", options.TLSClientCA, "PEM file with CA certificates to require and verify client certificates with; it is reloaded when changed")
+    flagSet.IntVar(&options.TLSHandshakeTimeout, "tls-handshake-timeout", options.TLSHandshakeTimeout, "time in seconds for the client TLS handshake to complete")
+    flagSet.BoolVar(&options.BackendTLS, "backend-tls", options.BackendTLS, "connect to the endpoints over TLS")
+    flagSet.StringVar(&options.BackendCA, "backend-ca", options.BackendCA, "PEM file with CA certificates to verify the endpoints with; system CAs are used by default")
+    flagSet.StringVar(&options.BackendCert, "backend-cert", options.BackendCert, "PEM client certificate file to present to the endpoints")
+    flagSet.StringVar(&options.BackendKey, "backend-key", options.BackendKey, "PEM private key file for the backend client certificate")
+    flagSet.StringVar(&options.BackendServerName, "backend-server-name", options.BackendServerName, "server name to send and verify for the endpoints registered without one; endpoint host is used by default, so unix socket endpoints need either this or their own server name")
+    flagSet.IntVar(&options.UDPSessionTimeout, "udp-session-timeout", options.UDPSessionTimeout, "time in seconds without datagrams in both directions to forget the UDP client flow after; next datagrams of the client start a new flow")
+    flagSet.IntVar(&options.DrainTimeout, "drain-timeout", options.DrainTimeout, "time in seconds to wait for active connections to finish on shutdown before closing them forcibly")
 }
 
 func printCommonUsageAndExit() {
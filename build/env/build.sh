@@ -3,7 +3,7 @@
 OLD_WD="$PWD"
 cd "$(dirname "$0")"
 
-GO_VERSION="1.8"
+GO_VERSION="1.11"
 GO_BUILD_IMAGE="maxmanuylov/go-build"
 
 sed -e "s|@GO_VERSION@|$GO_VERSION|g" Dockerfile.dist > Dockerfile
@@ -15,17 +15,19 @@ import (
     "time"
 )
 
-type StringHolder struct {
-    Value string
-}
+const unixHostPrefix = "unix@"
 
 type Config struct {
-    Type      string
-    Host      string
-    Health    *StringHolder // Health check can be disabled
-    Period    int
-    Tolerance int
-    Etcd      string
+    Type       string
+    Host       string
+    Health     *utils.StringHolder // Health check can be disabled
+    Weight     *utils.IntHolder // Weight can be zero
+    Zone       *utils.StringHolder // Zone is optional
+    Priority   *utils.IntHolder // Priority can be zero
+    ServerName *utils.StringHolder // Server name is optional
+    Period     int
+    Tolerance  int
+    Etcd       string
 }
 
 func Run(config *Config, logger *log.Logger) error {
@@ -59,6 +61,7 @@ type runtimeData struct {
     healthUrl  string
     etcdClient etcd.Client
     etcdKey    string
+    etcdValue  string
     ttl        time.Duration
 }
 
@@ -67,25 +70,33 @@ func (config *Config) createRuntimeData(logger *log.Logger) (*runtimeData, error
         return nil, errors.New("Invalid symbol in type: '/'")
     }
 
-    host, port, err := net.SplitHostPort(config.Host)
-    if err != nil {
+    if err := checkHost(config.Host); err != nil {
         return nil, err
     }
 
-    if strings.Contains(host, "/") {
-        return nil, errors.New("Invalid symbol in host: '/'")
+    if config.Weight.Value < 0 {
+        return nil, errors.New("Weight must not be negative")
     }
 
-    if port != "*" {
-        if _, err := utils.ParsePort(port); err != nil {
-            return nil, err
-        }
+    if config.Priority.Value < 0 {
+        return nil, errors.New("Priority must not be negative")
     }
 
     if config.Period <= 0 {
         return nil, errors.New("Period must be positive")
     }
 
+    itemValue := etcd_utils.NewItemValue()
+    itemValue.Weight = config.Weight.Value
+    itemValue.Zone = config.Zone.Value
+    itemValue.Priority = config.Priority.Value
+    itemValue.ServerName = config.ServerName.Value
+
+    etcdValue, err := itemValue.Encode()
+    if err != nil {
+        return nil, err
+    }
+
     periodDuration := time.Duration(config.Period) * time.Second
     semiPeriodDuration := periodDuration / 2
 
@@ -106,11 +117,39 @@ func (config *Config) createRuntimeData(logger *log.Logger) (*runtimeData, error
         },
         healthUrl: config.Health.Value,
         etcdClient: etcdClient,
-        etcdKey: fmt.Sprintf("%s/%s", etcd_utils.EtcdItemsKey(config.Type), config.Host),
+        etcdKey: fmt.Sprintf("%s/%s", etcd_utils.EtcdItemsKey(config.Type), etcd_utils.EscapeItemHost(config.Host)),
+        etcdValue: etcdValue,
         ttl: periodDuration * time.Duration(config.Tolerance) + semiPeriodDuration,
     }, nil
 }
 
+// Host is either "<ip>:<port>" or "unix@<socket path>"
+func checkHost(host string) error {
+    if strings.HasPrefix(host, unixHostPrefix) {
+        if host == unixHostPrefix {
+            return errors.New("Unix socket path must not be empty")
+        }
+        return nil
+    }
+
+    host, port, err := net.SplitHostPort(host)
+    if err != nil {
+        return err
+    }
+
+    if strings.Contains(host, "/") {
+        return errors.New("Invalid symbol in host: '/'")
+    }
+
+    if port != "*" {
+        if _, err := utils.ParsePort(port); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
 func checkAndRefreshItem(data *runtimeData) {
     isAlive, err := isItemAlive(data)
     if err != nil {
@@ -152,26 +191,26 @@ func refreshItem(data *runtimeData) error {
 
     backgroundContext := context.Background()
 
-    _, err := keys.Set(backgroundContext, data.etcdKey, "42", &etcd.SetOptions{
-        PrevExist: etcd.PrevNoExist,
+    _, err := keys.Set(backgroundContext, data.etcdKey, "", &etcd.SetOptions{
+        PrevValue: data.etcdValue,
         TTL: data.ttl,
-        Refresh: false,
+        Refresh: true,
     })
 
-    if err != nil && !isAlreadyExistsError(err) {
+    if err == nil || !isOutdatedError(err) {
         return err
     }
 
-    _, err = keys.Set(backgroundContext, data.etcdKey, "", &etcd.SetOptions{
-        PrevExist: etcd.PrevExist,
+    // The key is either expired or written by the previous run with other settings
+    _, err = keys.Set(backgroundContext, data.etcdKey, data.etcdValue, &etcd.SetOptions{
         TTL: data.ttl,
-        Refresh: true,
+        Refresh: false,
     })
 
     return err
 }
 
-func isAlreadyExistsError(err error) bool {
+func isOutdatedError(err error) bool {
     etcdErr, ok := err.(etcd.Error)
-    return ok && etcdErr.Code == etcd.ErrorCodeNodeExist
+    return ok && (etcdErr.Code == etcd.ErrorCodeKeyNotFound || etcdErr.Code == etcd.ErrorCodeTestFailed)
 }
\ No newline at end of file
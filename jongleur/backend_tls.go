@@ -0,0 +1,95 @@
+package jongleur
+
+import (
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "github.com/maxmanuylov/jongleur/utils/cycle"
+    "net"
+    "strings"
+    "time"
+)
+
+// TLS settings for the connections to the endpoints
+type backendTLS struct {
+    config     *tls.Config
+    serverName string // Used for the endpoints registered without server name; empty value means the endpoint host
+}
+
+func (options *Options) backendTLS() (*backendTLS, error) {
+    if !options.BackendTLS {
+        if options.BackendCA != "" || options.BackendCert != "" || options.BackendKey != "" || options.BackendServerName != "" {
+            return nil, errors.New("Backend TLS settings require backend TLS to be enabled")
+        }
+        return nil, nil
+    }
+
+    if (options.BackendCert == "") != (options.BackendKey == "") {
+        return nil, errors.New("Both backend TLS client certificate and key must be specified")
+    }
+
+    config := &tls.Config{}
+
+    if options.BackendCA != "" {
+        pool, err := loadCertPool(options.BackendCA)
+        if err != nil {
+            return nil, err
+        }
+        config.RootCAs = pool
+    }
+
+    if options.BackendCert != "" {
+        certificate, err := tls.LoadX509KeyPair(options.BackendCert, options.BackendKey)
+        if err != nil {
+            return nil, err
+        }
+        config.Certificates = []tls.Certificate{certificate}
+    }
+
+    return &backendTLS{config: config, serverName: options.BackendServerName}, nil
+}
+
+func (backend *backendTLS) handshake(serviceConnection net.Conn, endpoint *cycle.Endpoint, deadline time.Time) (*tls.Conn, error) {
+    serverName, err := backend.verifyName(endpoint)
+    if err != nil {
+        return nil, err
+    }
+
+    config := backend.config.Clone()
+    config.ServerName = serverName
+
+    tlsConnection := tls.Client(serviceConnection, config)
+
+    tlsConnection.SetDeadline(deadline)
+
+    if err := tlsConnection.Handshake(); err != nil {
+        return nil, err
+    }
+
+    tlsConnection.SetDeadline(time.Time{})
+
+    return tlsConnection, nil
+}
+
+// Server name registered with the item takes precedence over the proxy wide one; the endpoint host is used if there
+// is no server name, so unix socket endpoints must have one
+func (backend *backendTLS) verifyName(endpoint *cycle.Endpoint) (string, error) {
+    if serverName := endpoint.ServerName(); serverName != "" {
+        return serverName, nil
+    }
+
+    if backend.serverName != "" {
+        return backend.serverName, nil
+    }
+
+    network, addr := SplitNetAddr(endpoint.Host)
+    if strings.HasPrefix(network, "unix") {
+        return "", fmt.Errorf("No TLS server name for unix socket endpoint \"%s\": register the item with a server name or specify the backend server name", endpoint.Host)
+    }
+
+    if host, _, err := net.SplitHostPort(addr); err == nil {
+        return host, nil
+    }
+
+    return addr, nil
+}
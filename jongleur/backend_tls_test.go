@@ -0,0 +1,56 @@
+package jongleur
+
+import (
+    "github.com/maxmanuylov/jongleur/utils/cycle"
+    "testing"
+)
+
+func TestBackendVerifyName(t *testing.T) {
+    picker, err := cycle.NewPicker(DefaultOptions().pickerConfig(), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    picker.SyncItems([]cycle.Item{
+        {Host: "10.0.0.1:443", Weight: 1},
+        {Host: "[2001:db8::1]:443", Weight: 1},
+        {Host: "10.0.0.2:*", Weight: 1},
+        {Host: "10.0.0.3:443", Weight: 1, ServerName: "svc.internal"},
+        {Host: "unix@/run/svc.sock", Weight: 1},
+        {Host: "unix@/run/named.sock", Weight: 1, ServerName: "svc.internal"},
+    })
+
+    endpoints := make(map[string]*cycle.Endpoint)
+    for _, endpoint := range picker.Endpoints() {
+        endpoints[endpoint.Host] = endpoint
+    }
+
+    tests := []struct {
+        host        string
+        backendName string
+        expected    string // Empty if an error is expected
+    }{
+        {"10.0.0.1:443", "", "10.0.0.1"},
+        {"10.0.0.1:443", "backend.internal", "backend.internal"},
+        {"[2001:db8::1]:443", "", "2001:db8::1"},
+        {"10.0.0.2:*", "", "10.0.0.2"},
+        {"10.0.0.3:443", "backend.internal", "svc.internal"},
+        {"unix@/run/svc.sock", "", ""},
+        {"unix@/run/svc.sock", "backend.internal", "backend.internal"},
+        {"unix@/run/named.sock", "", "svc.internal"},
+    }
+
+    for _, test := range tests {
+        backend := &backendTLS{serverName: test.backendName}
+
+        serverName, err := backend.verifyName(endpoints[test.host])
+
+        if test.expected == "" {
+            if err == nil {
+                t.Errorf("%s: expected an error, got %q", test.host, serverName)
+            }
+        } else if err != nil || serverName != test.expected {
+            t.Errorf("%s with backend server name %q: expected %q, got %q (%v)", test.host, test.backendName, test.expected, serverName, err)
+        }
+    }
+}
@@ -10,6 +10,13 @@ import (
     "strings"
 )
 
+const (
+    afInet            = 2
+    afInet6           = 10 // Linux value, which Ceph uses on the wire
+    sockaddrIn6Length = 28
+    bannerAddrOffset  = 17 // "ceph v027" banner, then entity address type and nonce, 4 bytes each
+)
+
 type Config struct {
     regular.Config
 }
@@ -40,15 +47,39 @@ func (config *Config) ToJongleurConfig() (*jongleur.Config, error) {
         return nil, fmt.Errorf("Failed to parse TCP port \"%s\": %v", portStr, err)
     }
 
-    jongleurConfig.ResponsePatcher = func(originalWriter io.Writer) io.Writer {
+    jongleurConfig.ResponsePatcher = addrPatcher(ip, port)
+
+    return jongleurConfig, nil
+}
+
+// Replaces the monitor address sent right after the banner with the proxy one
+func addrPatcher(ip net.IP, port int) jongleur.Patcher {
+    return func(originalWriter io.Writer) io.Writer {
         return &bytesPatcher{
             originalWriter: originalWriter,
-            newBytes: append([]byte{byte(port / 256), byte(port % 256)}, ip.To4()...),
-            skip: 19,
+            newBytes: encodeSockaddr(ip, port),
+            skip: bannerAddrOffset,
         }
     }
+}
 
-    return jongleurConfig, nil
+// Ceph encodes monitor address as sockaddr_storage with family, port and address in network byte order;
+// the encoded value covers both sockaddr_in and sockaddr_in6, so that a monitor of one family can be replaced
+// with a proxy of another one
+func encodeSockaddr(ip net.IP, port int) []byte {
+    sockaddr := make([]byte, sockaddrIn6Length)
+
+    sockaddr[2], sockaddr[3] = byte(port / 256), byte(port % 256)
+
+    if ip4 := ip.To4(); ip4 != nil {
+        sockaddr[1] = afInet
+        copy(sockaddr[4:], ip4)
+    } else {
+        sockaddr[1] = afInet6
+        copy(sockaddr[8:], ip.To16()) // After flow info
+    }
+
+    return sockaddr
 }
 
 type bytesPatcher struct {
@@ -0,0 +1,93 @@
+package ceph
+
+import (
+    "bytes"
+    "net"
+    "testing"
+)
+
+func TestEncodeSockaddr(t *testing.T) {
+    tests := []struct {
+        ip       string
+        port     int
+        expected []byte
+    }{
+        {"10.0.0.1", 6789, []byte{
+            0, afInet, 0x1A, 0x85, 10, 0, 0, 1,
+            0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+        }},
+        {"2001:db8::1", 3300, []byte{
+            0, afInet6, 0x0C, 0xE4, 0, 0, 0, 0, // Family, port and flow info
+            0x20, 0x01, 0x0D, 0xB8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+            0, 0, 0, 0, // Scope ID
+        }},
+        {"::ffff:10.0.0.1", 6789, []byte{ // IPv4-mapped address is sent as IPv4
+            0, afInet, 0x1A, 0x85, 10, 0, 0, 1,
+            0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+        }},
+    }
+
+    for _, test := range tests {
+        if sockaddr := encodeSockaddr(net.ParseIP(test.ip), test.port); !bytes.Equal(sockaddr, test.expected) {
+            t.Errorf("%s:%d: expected % x, got % x", test.ip, test.port, test.expected, sockaddr)
+        }
+    }
+}
+
+// Legacy messenger banner followed by the monitor entity address: type, nonce and sockaddr_storage
+func monitorHello(sockaddr []byte) []byte {
+    hello := []byte("ceph v027")
+    hello = append(hello, 0, 0, 0, 0) // Type
+    hello = append(hello, 0, 0, 0, 42) // Nonce
+
+    storage := make([]byte, 128)
+    copy(storage, sockaddr)
+
+    hello = append(hello, storage...)
+    return append(hello, []byte("rest of the handshake")...)
+}
+
+func TestAddrPatcher(t *testing.T) {
+    monitor := encodeSockaddr(net.ParseIP("10.0.0.1"), 6789)
+
+    tests := []struct {
+        ip   string
+        port int
+    }{
+        {"192.168.0.1", 16789},
+        {"2001:db8::1", 16789}, // IPv6 proxy for IPv4 monitor
+    }
+
+    for _, test := range tests {
+        proxy := encodeSockaddr(net.ParseIP(test.ip), test.port)
+
+        original := monitorHello(monitor)
+        expected := monitorHello(proxy)
+
+        if !bytes.Equal(original[bannerAddrOffset:bannerAddrOffset + 2], []byte{0, afInet}) {
+            t.Fatalf("Monitor address family is not at offset %d", bannerAddrOffset)
+        }
+
+        for _, chunkSize := range []int{1, 5, bannerAddrOffset, 20, len(original)} {
+            output := &bytes.Buffer{}
+            writer := addrPatcher(net.ParseIP(test.ip), test.port)(output)
+
+            for rest := original; len(rest) != 0; {
+                size := chunkSize
+                if size > len(rest) {
+                    size = len(rest)
+                }
+
+                if n, err := writer.Write(rest[:size]); err != nil || n != size {
+                    t.Fatalf("Write of %d bytes returned %d, %v", size, n, err)
+                }
+
+                rest = rest[size:]
+            }
+
+            if !bytes.Equal(output.Bytes(), expected) {
+                t.Errorf("%s:%d in chunks of %d: expected\n% x\ngot\n% x", test.ip, test.port, chunkSize, expected, output.Bytes())
+            }
+        }
+    }
+}
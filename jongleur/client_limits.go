@@ -0,0 +1,159 @@
+package jongleur
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const clientSweepPeriod = time.Minute
+
+// Per client address limits: a token bucket for new connections and a limit of concurrent connections.
+// Clients are grouped by network prefix, so that a whole subnet can share the limits.
+type clientLimits struct {
+    limited    int64 // Accessed atomically; 64-bit fields are kept first for alignment
+
+    rate       float64 // New connections per second; zero means no limit
+    burst      float64
+    maxConns   int // Zero means no limit
+    ipv4Mask   net.IPMask
+    ipv6Mask   net.IPMask
+
+    clients    map[string]*clientState
+    lastSweep  time.Time
+    lock       *sync.Mutex
+}
+
+type clientState struct {
+    tokens  float64
+    updated time.Time
+    active  int
+}
+
+func (options *Options) clientLimits() (*clientLimits, error) {
+    if options.ClientRate < 0 || options.ClientBurst < 0 || options.ClientMaxConns < 0 {
+        return nil, errors.New("Client limits must not be negative")
+    }
+
+    if options.ClientPrefix4 < 0 || options.ClientPrefix4 > 32 {
+        return nil, errors.New("Client IPv4 prefix length must be in range [0, 32]")
+    }
+
+    if options.ClientPrefix6 < 0 || options.ClientPrefix6 > 128 {
+        return nil, errors.New("Client IPv6 prefix length must be in range [0, 128]")
+    }
+
+    burst := options.ClientBurst
+    if burst < options.ClientRate {
+        burst = options.ClientRate
+    }
+
+    return &clientLimits{
+        rate: float64(options.ClientRate),
+        burst: float64(burst),
+        maxConns: options.ClientMaxConns,
+        ipv4Mask: net.CIDRMask(options.ClientPrefix4, 32),
+        ipv6Mask: net.CIDRMask(options.ClientPrefix6, 128),
+        clients: make(map[string]*clientState),
+        lastSweep: time.Now(),
+        lock: &sync.Mutex{},
+    }, nil
+}
+
+func (l *clientLimits) enabled() bool {
+    return l.rate > 0 || l.maxConns > 0
+}
+
+// Returns a function to be called when the admitted connection is finished, or an error if the client exceeds its limits
+func (l *clientLimits) admit(clientAddr net.Addr) (func(), error) {
+    if !l.enabled() {
+        return nil, nil
+    }
+
+    key, ok := l.key(clientAddr)
+    if !ok {
+        return nil, nil // Not an IP client, e.g. a unix socket one
+    }
+
+    l.lock.Lock()
+    defer l.lock.Unlock()
+
+    now := time.Now()
+    l.sweep(now)
+
+    client, ok := l.clients[key]
+    if !ok {
+        client = &clientState{tokens: l.burst, updated: now}
+        l.clients[key] = client
+    }
+
+    if l.maxConns > 0 && client.active >= l.maxConns {
+        return nil, fmt.Errorf("client %s has %d active connections", key, client.active)
+    }
+
+    if l.rate > 0 {
+        client.tokens += now.Sub(client.updated).Seconds() * l.rate
+        if client.tokens > l.burst {
+            client.tokens = l.burst
+        }
+        client.updated = now
+
+        if client.tokens < 1 {
+            return nil, fmt.Errorf("client %s exceeds the connection rate", key)
+        }
+
+        client.tokens--
+    }
+
+    client.active++
+
+    return func() {
+        l.leave(client)
+    }, nil
+}
+
+func (l *clientLimits) leave(client *clientState) {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+
+    client.active--
+}
+
+// Forgets the clients having no active connections and a full bucket
+func (l *clientLimits) sweep(now time.Time) {
+    if now.Sub(l.lastSweep) < clientSweepPeriod {
+        return
+    }
+
+    l.lastSweep = now
+
+    for key, client := range l.clients {
+        if client.active == 0 && (l.rate <= 0 || client.tokens + now.Sub(client.updated).Seconds() * l.rate >= l.burst) {
+            delete(l.clients, key)
+        }
+    }
+}
+
+func (l *clientLimits) key(clientAddr net.Addr) (string, bool) {
+    clientIP := clientIP(clientAddr)
+    if clientIP == nil {
+        return "", false
+    }
+
+    if ip := clientIP.To4(); ip != nil {
+        return (&net.IPNet{IP: ip.Mask(l.ipv4Mask), Mask: l.ipv4Mask}).String(), true
+    }
+
+    return (&net.IPNet{IP: clientIP.Mask(l.ipv6Mask), Mask: l.ipv6Mask}).String(), true
+}
+
+func (l *clientLimits) reject() int64 {
+    return atomic.AddInt64(&l.limited, 1)
+}
+
+func (l *clientLimits) stats() int64 {
+    return atomic.LoadInt64(&l.limited)
+}
@@ -0,0 +1,52 @@
+package jongleur
+
+import (
+    "net"
+    "testing"
+)
+
+func TestClientLimitsApplyToUDPFlows(t *testing.T) {
+    options := DefaultOptions()
+    options.ClientMaxConns = 1
+
+    l, err := options.clientLimits()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    first := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+    second := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2000} // Same client, another flow
+
+    release, err := l.admit(first)
+    if err != nil || release == nil {
+        t.Fatalf("The first flow must be admitted and tracked, got %v", err)
+    }
+
+    if _, err := l.admit(second); err == nil {
+        t.Error("The second flow of the same client must be rejected")
+    }
+
+    release()
+
+    if _, err := l.admit(second); err != nil {
+        t.Errorf("The flow must be admitted after the first one is finished: %v", err)
+    }
+}
+
+func TestClientKeyIgnoresPort(t *testing.T) {
+    tests := []struct {
+        addr     net.Addr
+        expected string
+    }{
+        {&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}, "10.0.0.1"},
+        {&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2000}, "10.0.0.1"},
+        {&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 2000}, "2001:db8::1"},
+        {&net.UnixAddr{Name: "/run/client.sock", Net: "unix"}, "/run/client.sock"},
+    }
+
+    for _, test := range tests {
+        if key := clientKey(test.addr); key != test.expected {
+            t.Errorf("%v: expected key %q, got %q", test.addr, test.expected, key)
+        }
+    }
+}
@@ -0,0 +1,98 @@
+package jongleur
+
+import (
+    "io"
+    "sync"
+    "time"
+)
+
+// Active client connections along with their service connections, so that they can be waited for or closed on shutdown
+type connections struct {
+    active map[int64]*activeConnection
+    done   chan struct{} // Closed when the last connection is removed after wait() is called
+    lock   *sync.Mutex
+}
+
+type activeConnection struct {
+    closers []io.Closer
+    release func() // Called on removal; can be nil
+}
+
+func newConnections() *connections {
+    return &connections{active: make(map[int64]*activeConnection), lock: &sync.Mutex{}}
+}
+
+func (c *connections) add(n int64, clientConnection io.Closer, release func()) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    c.active[n] = &activeConnection{[]io.Closer{clientConnection}, release}
+}
+
+func (c *connections) attach(n int64, serviceConnection io.Closer) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    if connection, ok := c.active[n]; ok {
+        connection.closers = append(connection.closers, serviceConnection)
+    }
+}
+
+func (c *connections) remove(n int64) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    if connection, ok := c.active[n]; ok && connection.release != nil {
+        connection.release()
+    }
+
+    delete(c.active, n)
+
+    if len(c.active) == 0 && c.done != nil {
+        close(c.done)
+        c.done = nil
+    }
+}
+
+func (c *connections) count() int {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    return len(c.active)
+}
+
+// Returns false if some connections are still active after the timeout
+func (c *connections) wait(timeout time.Duration) bool {
+    c.lock.Lock()
+
+    if len(c.active) == 0 {
+        c.lock.Unlock()
+        return true
+    }
+
+    done := make(chan struct{})
+    c.done = done
+
+    c.lock.Unlock()
+
+    select {
+    case <-done:
+        return true
+    case <-time.After(timeout):
+        return false
+    }
+}
+
+// Returns the number of the closed client connections
+func (c *connections) closeAll() int {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    for _, connection := range c.active {
+        for _, closer := range connection.closers {
+            closer.Close()
+        }
+    }
+
+    return len(c.active)
+}
@@ -8,6 +8,7 @@ import (
     "github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
     "github.com/maxmanuylov/jongleur/jongleur"
     "github.com/maxmanuylov/jongleur/utils"
+    "github.com/maxmanuylov/jongleur/utils/cycle"
     "github.com/maxmanuylov/jongleur/utils/etcd"
     "net/http"
     "net/url"
@@ -18,6 +19,7 @@ type Config struct {
     Listen    string
     Period    int
     Discovery string
+    Options   *jongleur.Options
 }
 
 func (config *Config) ToJongleurConfig() (*jongleur.Config, error) {
@@ -40,17 +42,17 @@ func (config *Config) ToJongleurConfig() (*jongleur.Config, error) {
         return nil, err
     }
 
-    itemsLoader, err := etcd_utils.NewEtcdItemsLoader(config.Period, etcdCluster.ClientURLs(), func (etcdClient _etcd.Client) ([]string, error) {
+    itemsLoader, err := etcd_utils.NewEtcdItemsLoader(config.Period, etcdCluster.ClientURLs(), func (etcdClient _etcd.Client) ([]cycle.Item, error) {
         if err := etcdClient.Sync(context.Background()); err != nil {
             return nil, err
         }
 
-        newItems := make([]string, 0)
+        newItems := make([]cycle.Item, 0)
 
         for _, endpoint := range etcdClient.Endpoints() {
             endpointUrl, err := url.Parse(endpoint)
             if err == nil {
-                newItems = append(newItems, endpointUrl.Host)
+                newItems = append(newItems, cycle.Item{Host: endpointUrl.Host, Weight: etcd_utils.DefaultItemWeight})
             }
         }
 
@@ -64,5 +66,6 @@ func (config *Config) ToJongleurConfig() (*jongleur.Config, error) {
         ItemsLoader: itemsLoader,
         RequestPatcher: jongleur.IDENTICAL_PATCHER,
         ResponsePatcher: jongleur.IDENTICAL_PATCHER,
+        Options: config.Options,
     }, err
 }
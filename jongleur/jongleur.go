@@ -1,6 +1,7 @@
 package jongleur
 
 import (
+    "context"
     "errors"
     "github.com/maxmanuylov/jongleur/utils"
     "github.com/maxmanuylov/jongleur/utils/cycle"
@@ -11,10 +12,13 @@ import (
     "os"
     "path/filepath"
     "strings"
+    "sync"
     "time"
 )
 
-type ItemsLoader func () ([]string, error)
+const statsReportPeriod = 10 * time.Second
+
+type ItemsLoader func () ([]cycle.Item, error)
 
 type Patcher func(io.Writer) io.Writer
 
@@ -29,97 +33,469 @@ type Config struct {
     ItemsLoader     ItemsLoader
     RequestPatcher  Patcher
     ResponsePatcher Patcher
+    Options         *Options // DefaultOptions() if nil
+}
+
+// Proxy tuning; use DefaultOptions() and override what is needed
+type Options struct {
+    Balance             string // Strategy name, e.g. cycle.RoundRobin
+    EjectFailures       int // Zero disables outlier ejection
+    EjectTime           int // Seconds
+    MaxEjectPercent     int
+    ProbeInterval       int // Seconds; zero disables active health checks
+    ProbeTimeout        int // Seconds
+    ProbeSend           string // Go escape sequences are supported
+    ProbeExpect         string // Expected response prefix; Go escape sequences are supported
+    ProbeRise           int
+    ProbeFall           int
+    Zone                string // Endpoints of this zone are preferred; empty value disables zone-aware routing
+    ZoneMinHealthy      int // Percent
+    SlowStart           int // Seconds; zero disables slow start
+    DrainTimeout        int // Seconds to wait for active connections on shutdown
+    ConnectAttempts     int
+    ConnectTimeout      int // Milliseconds per attempt
+    ConnectDeadline     int // Milliseconds for all the attempts; zero means no deadline
+    RetryBackoff        int // Milliseconds before the first retry; it doubles for every next retry
+    IdleTimeout         int // Seconds without data in both directions to close the connection after; zero means no limit
+    MaxConnLifetime     int // Seconds; zero means no limit
+    MaxConns            int // Zero means no limit
+    MaxConnsPerEndpoint int // Zero means no limit
+    QueueSize           int // Connections waiting for a free slot when the limits are reached
+    QueueTimeout        int // Milliseconds
+    ClientRate          int // New connections per second from a single client; zero means no limit
+    ClientBurst         int // New connections a client can open at once before the rate applies
+    ClientMaxConns      int // Concurrent connections from a single client; zero means no limit
+    ClientPrefix4       int // IPv4 clients sharing the prefix of this length share the limits
+    ClientPrefix6       int // IPv6 clients sharing the prefix of this length share the limits
+    SendProxy           string // PROXY protocol version to send to the endpoints; empty value disables it
+    AcceptProxy         bool // Client connections are expected to start with a PROXY protocol header
+    ProxyTrusted        string // Comma separated CIDRs to accept PROXY protocol addresses from; empty value trusts all the sources
+    TLSCert             string // PEM file; TLS is terminated on the listener if specified
+    TLSKey              string // PEM file
+    TLSClientCA         string // PEM file; client certificates are required and verified if specified
+    TLSHandshakeTimeout int // Seconds
+    BackendTLS          bool // Connections to the endpoints are made over TLS
+    BackendCA           string // PEM file to verify the endpoints with; system CAs are used if not specified
+    BackendCert         string // PEM client certificate file for the endpoints requiring one
+    BackendKey          string // PEM file
+    BackendServerName   string // Name to send as SNI and to verify for the endpoints registered without one
+    SNIRoutes           []SNIRoute // Connections not matching any route go to the config items
+    UDPSessionTimeout   int // Seconds without datagrams in both directions to forget the UDP flow after
+    Transparent         bool // Connections are redirected to the proxy; endpoints with "*" port get them on the original port
 }
 
+func DefaultOptions() *Options {
+    return &Options{
+        Balance: cycle.RoundRobin,
+        EjectFailures: 5,
+        EjectTime: 10,
+        MaxEjectPercent: 50,
+        ProbeInterval: 0,
+        ProbeTimeout: 2,
+        ProbeRise: 2,
+        ProbeFall: 3,
+        ZoneMinHealthy: 70,
+        DrainTimeout: 30,
+        ConnectAttempts: 10,
+        ConnectTimeout: 2000,
+        ConnectDeadline: 0,
+        RetryBackoff: 0,
+        IdleTimeout: 0,
+        MaxConnLifetime: 0,
+        MaxConns: 0,
+        MaxConnsPerEndpoint: 0,
+        QueueSize: 100,
+        QueueTimeout: 5000,
+        ClientRate: 0,
+        ClientBurst: 0,
+        ClientMaxConns: 0,
+        ClientPrefix4: 32,
+        ClientPrefix6: 128,
+        TLSHandshakeTimeout: 10,
+        UDPSessionTimeout: 30,
+    }
+}
+
+// Runs the proxy until termination signal, then shuts it down gracefully
 func Run(config *Config, logger *log.Logger) error {
-    if err := utils.Check(config); err != nil {
+    return RunGroup([]*Config{config}, logger)
+}
+
+// Runs several proxies until termination signal, then shuts them down gracefully
+func RunGroup(configs []*Config, logger *log.Logger) error {
+    group, err := StartGroup(configs, logger)
+    if err != nil {
         return err
     }
 
-    data, err := config.createRuntimeData(logger)
+    application.WaitForTermination()
+
+    group.Shutdown()
+
+    return nil
+}
+
+type Proxy struct {
+    data     *runtimeData
+    listener io.Closer // net.Listener or net.PacketConn
+}
+
+func Start(config *Config, logger *log.Logger) (*Proxy, error) {
+    config = config.withDefaultOptions()
+
+    shared, err := config.Options.sharedLimits()
     if err != nil {
-        return err
+        return nil, err
     }
 
-    defer data.mcycle.Stop()
+    proxy, err := start(config, logger, shared)
+    if err != nil {
+        return nil, err
+    }
 
-    syncTicker := time.NewTicker(data.period)
-    defer syncTicker.Stop()
+    go runSync(proxy.data.period, proxy.data.routes, logger, proxy.data.stop)
+    go runStatsReport(proxy.Stats, logger, proxy.data.stop)
+
+    return proxy, nil
+}
+
+// Proxies of several listeners sharing one items synchronization loop
+type Group struct {
+    Proxies []*Proxy
+    stop    chan struct{}
+}
+
+// Items of all the proxies are synchronized with the shortest period of them; connection limits of the first config
+// apply to all the proxies together
+func StartGroup(configs []*Config, logger *log.Logger) (*Group, error) {
+    if len(configs) == 0 {
+        return nil, errors.New("No proxies to start")
+    }
+
+    shared, err := configs[0].withDefaultOptions().Options.sharedLimits()
+    if err != nil {
+        return nil, err
+    }
+
+    group := &Group{stop: make(chan struct{})}
+
+    var period time.Duration
+    var routes []*route
+
+    for _, config := range configs {
+        proxy, err := start(config, logger, shared)
+        if err != nil {
+            group.Shutdown()
+            return nil, err
+        }
+
+        group.Proxies = append(group.Proxies, proxy)
+        routes = append(routes, proxy.data.routes...)
 
-    go func() {
-        syncItems(data)
-        for range syncTicker.C {
-            syncItems(data)
+        if period == 0 || proxy.data.period < period {
+            period = proxy.data.period
         }
-    }()
+    }
+
+    go runSync(period, routes, logger, group.stop)
+    go runStatsReport(group.Stats, logger, group.stop)
+
+    return group, nil
+}
+
+// Active connections are summed over the proxies, the other counters are shared by them
+func (group *Group) Stats() Stats {
+    stats := group.Proxies[0].Stats()
+
+    for _, proxy := range group.Proxies[1:] {
+        stats.Active += proxy.data.connections.count()
+    }
+
+    return stats
+}
 
-    listener, err := config.listen()
+// Shuts down all the proxies at the same time
+func (group *Group) Shutdown() {
+    close(group.stop)
+
+    var wg sync.WaitGroup
+    for _, proxy := range group.Proxies {
+        wg.Add(1)
+        go func(proxy *Proxy) {
+            defer wg.Done()
+            proxy.Shutdown()
+        }(proxy)
+    }
+    wg.Wait()
+}
+
+// Starts the proxy without items synchronization
+func start(config *Config, logger *log.Logger, shared *sharedLimits) (*Proxy, error) {
+    config = config.withDefaultOptions()
+
+    if err := utils.Check(config); err != nil {
+        return nil, err
+    }
+
+    data, err := config.createRuntimeData(logger, shared)
     if err != nil {
-        return err
+        return nil, err
+    }
+
+    if network, _ := config.SplitNetAddr(); isUDP(network) {
+        return startUDP(config, data)
     }
 
-    defer listener.Close()
+    listener, err := config.listen(logger)
+    if err != nil {
+        return nil, err
+    }
+
+    if data.tls != nil {
+        go data.tls.watch(data.stop)
+    }
+
+    if data.probe != nil {
+        for _, route := range data.routes {
+            go runProber(data, route.picker)
+        }
+    }
 
     go runProxy(listener, data)
     data.logger.Printf("Listening for TCP connections on %+v\n", listener.Addr())
 
-    application.WaitForTermination()
+    return &Proxy{data, listener}, nil
+}
 
-    return nil
+func startUDP(config *Config, data *runtimeData) (*Proxy, error) {
+    if err := data.checkUDP(); err != nil {
+        return nil, err
+    }
+
+    listener, err := net.ListenPacket(config.SplitNetAddr())
+    if err != nil {
+        return nil, err
+    }
+
+    go runUDPProxy(listener, data)
+    data.logger.Printf("Listening for UDP datagrams on %+v\n", listener.LocalAddr())
+
+    return &Proxy{data, listener}, nil
+}
+
+// Stops accepting new connections and waits for the active ones to finish; the connections still active
+// after the drain timeout are closed forcibly
+func (proxy *Proxy) Shutdown() {
+    data := proxy.data
+
+    close(data.stop)
+    proxy.listener.Close()
+
+    active := data.connections.count()
+    data.logger.Printf("Shutting down, waiting for %d active connections to finish\n", active)
+
+    if data.connections.wait(data.drainTimeout) {
+        data.logger.Printf("All %d connections are finished\n", active)
+        return
+    }
+
+    closed := data.connections.closeAll()
+    data.logger.Printf("%d of %d connections are closed forcibly after %v drain timeout\n", closed, active, data.drainTimeout)
+}
+
+func (proxy *Proxy) Stats() Stats {
+    queued, rejected := proxy.data.limits.stats()
+
+    return Stats{
+        Active: proxy.data.connections.count(),
+        Queued: queued,
+        Rejected: rejected,
+        RateLimited: proxy.data.clientLimits.stats(),
+    }
+}
+
+// Logs the connection stats when they change, at most once per period
+func runStatsReport(stats func() Stats, logger *log.Logger, stop <-chan struct{}) {
+    reportTicker := time.NewTicker(statsReportPeriod)
+    defer reportTicker.Stop()
+
+    var reported Stats
+
+    for {
+        select {
+        case <-reportTicker.C:
+            reported = reportStats(stats(), reported, logger)
+        case <-stop:
+            return
+        }
+    }
+}
+
+// Logs the stats if they differ from the reported ones; returns the stats to compare the next ones with
+func reportStats(stats Stats, reported Stats, logger *log.Logger) Stats {
+    if stats != reported {
+        logger.Printf("Connections: %d active, %d queued, %d rejected, %d rate limited\n",
+            stats.Active, stats.Queued, stats.Rejected, stats.RateLimited)
+    }
+
+    return stats
+}
+
+func runSync(period time.Duration, routes []*route, logger *log.Logger, stop <-chan struct{}) {
+    syncTicker := time.NewTicker(period)
+    defer syncTicker.Stop()
+
+    syncItems(routes, logger)
+
+    for {
+        select {
+        case <-syncTicker.C:
+            syncItems(routes, logger)
+        case <-stop:
+            return
+        }
+    }
 }
 
 type runtimeData struct {
-    period          time.Duration
-    logger          *log.Logger
-    loadItems       ItemsLoader
-    mcycle          *cycle.MutableCycle
-    hosts           <-chan string
-    requestPatcher  Patcher
-    responsePatcher Patcher
-    verbose         bool
+    period            time.Duration
+    logger            *log.Logger
+    routes            []*route // The first one is the default route
+    probe             *probeConfig
+    connectPolicy     *connectPolicy
+    limits            *limits
+    clientLimits      *clientLimits
+    sendProxy         string
+    proxyTrust        *proxyTrust // Nil if PROXY protocol headers are not accepted
+    tls               *tlsTermination // Nil if TLS is not terminated
+    backendTLS        *backendTLS // Nil if the endpoints are connected without TLS
+    requestPatcher    Patcher
+    responsePatcher   Patcher
+    verbose           bool
+    drainTimeout      time.Duration
+    idleTimeout       time.Duration
+    maxConnLifetime   time.Duration
+    udpSessionTimeout time.Duration
+    transparent       bool
+    connections       *connections
+    stop              chan struct{}
 }
 
-func (config *Config) createRuntimeData(logger *log.Logger) (*runtimeData, error) {
+func (config *Config) createRuntimeData(logger *log.Logger, shared *sharedLimits) (*runtimeData, error) {
     if config.Period <= 0 {
         return nil, errors.New("Period must be positive")
     }
 
-    hosts := make(chan string)
+    if config.Options.DrainTimeout < 0 {
+        return nil, errors.New("Drain timeout must not be negative")
+    }
+
+    routes, err := config.routes(logger)
+    if err != nil {
+        return nil, err
+    }
+
+    probe, err := config.Options.probeConfig()
+    if err != nil {
+        return nil, err
+    }
+
+    connectPolicy, err := config.Options.connectPolicy()
+    if err != nil {
+        return nil, err
+    }
+
+    if err := checkProxyProtocol(config.Options.SendProxy); err != nil {
+        return nil, err
+    }
+
+    proxyTrust, err := config.Options.proxyTrust()
+    if err != nil {
+        return nil, err
+    }
+
+    tls, err := config.Options.tlsTermination(logger)
+    if err != nil {
+        return nil, err
+    }
+
+    backendTLS, err := config.Options.backendTLS()
+    if err != nil {
+        return nil, err
+    }
+
+    network, _ := config.SplitNetAddr()
+
+    if err := checkTransparent(config.Options.Transparent, network); err != nil {
+        return nil, err
+    }
 
     return &runtimeData{
         period: time.Duration(config.Period) * time.Second,
         logger: logger,
-        loadItems: config.ItemsLoader,
-        mcycle: cycle.NewMutableCycle(hosts, logger),
-        hosts: hosts,
+        routes: routes,
+        probe: probe,
+        connectPolicy: connectPolicy,
+        limits: shared.limits,
+        clientLimits: shared.clientLimits,
+        sendProxy: config.Options.SendProxy,
+        proxyTrust: proxyTrust,
+        tls: tls,
+        backendTLS: backendTLS,
         requestPatcher: config.RequestPatcher,
         responsePatcher: config.ResponsePatcher,
         verbose: config.Verbose,
+        drainTimeout: time.Duration(config.Options.DrainTimeout) * time.Second,
+        idleTimeout: time.Duration(config.Options.IdleTimeout) * time.Second,
+        maxConnLifetime: time.Duration(config.Options.MaxConnLifetime) * time.Second,
+        udpSessionTimeout: time.Duration(config.Options.UDPSessionTimeout) * time.Second,
+        transparent: config.Options.Transparent,
+        connections: newConnections(),
+        stop: make(chan struct{}),
     }, nil
 }
 
-func syncItems(data *runtimeData) {
-    newItems, err := data.loadItems()
-    if err != nil {
-        data.logger.Printf("Failed to load items: %v\n", err)
-        return
+func syncItems(routes []*route, logger *log.Logger) {
+    for _, route := range routes {
+        newItems, err := route.loadItems()
+        if err != nil {
+            logger.Printf("Failed to load items: %v\n", err)
+            continue
+        }
+
+        if newItems != nil {
+            route.picker.SyncItems(newItems)
+        }
     }
+}
 
-    if newItems != nil {
-        data.mcycle.SyncItems(newItems)
+// Configs built without options get the default ones; the original config is not changed
+func (config *Config) withDefaultOptions() *Config {
+    if config.Options != nil {
+        return config
     }
+
+    configCopy := *config
+    configCopy.Options = DefaultOptions()
+
+    return &configCopy
 }
 
 func (config *Config) SplitNetAddr() (string, string) {
-    atPos := strings.Index(config.Listen, "@")
+    return SplitNetAddr(config.Listen)
+}
+
+// Splits "[<network>@]<addr>" into network and address; default network is "tcp"
+func SplitNetAddr(netAddr string) (string, string) {
+    atPos := strings.Index(netAddr, "@")
     if atPos == -1 {
-        return "tcp", config.Listen
+        return "tcp", netAddr
     } else {
-        return config.Listen[:atPos], config.Listen[atPos + 1:]
+        return netAddr[:atPos], netAddr[atPos + 1:]
     }
 }
 
-func (config *Config) listen() (net.Listener, error) {
+func (config *Config) listen(logger *log.Logger) (net.Listener, error) {
     network, addr := config.SplitNetAddr()
 
     if strings.HasPrefix(network, "unix") {
@@ -128,5 +504,10 @@ func (config *Config) listen() (net.Listener, error) {
         }
     }
 
-    return net.Listen(network, addr)
+    listenConfig := &net.ListenConfig{}
+    if config.Options.Transparent {
+        listenConfig.Control = transparentListenControl(logger)
+    }
+
+    return listenConfig.Listen(context.Background(), network, addr)
 }
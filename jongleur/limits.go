@@ -0,0 +1,196 @@
+package jongleur
+
+import (
+    "errors"
+    "github.com/maxmanuylov/jongleur/utils/cycle"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+type Stats struct {
+    Active      int   // Client connections being served or queued
+    Queued      int   // Client connections waiting for a free slot; shared by the proxies of a group
+    Rejected    int64 // Client connections rejected because of the limits since start; shared by the proxies of a group
+    RateLimited int64 // Client connections rejected because of the per client limits since start; shared by the proxies of a group
+}
+
+// Limits applied to the connections of all the proxies of the process together
+type sharedLimits struct {
+    limits       *limits
+    clientLimits *clientLimits
+}
+
+func (options *Options) sharedLimits() (*sharedLimits, error) {
+    limits, err := options.limits()
+    if err != nil {
+        return nil, err
+    }
+
+    clientLimits, err := options.clientLimits()
+    if err != nil {
+        return nil, err
+    }
+
+    return &sharedLimits{limits, clientLimits}, nil
+}
+
+// Global and per-endpoint connection limits; connections exceeding the limits wait in a bounded queue
+type limits struct {
+    queued       int64 // Accessed atomically; 64-bit fields are kept first for alignment
+    rejected     int64 // Accessed atomically
+
+    slots        chan struct{} // Global semaphore; nil if there is no global limit
+    perEndpoint  int
+    queueSize    int64
+    queueTimeout time.Duration
+
+    endpoints    map[*cycle.Endpoint]int
+    released     chan struct{} // Closed and replaced every time an endpoint slot is released
+    lock         *sync.Mutex
+}
+
+func (options *Options) limits() (*limits, error) {
+    if options.MaxConns < 0 || options.MaxConnsPerEndpoint < 0 || options.QueueSize < 0 || options.QueueTimeout < 0 {
+        return nil, errors.New("Connection limits and queue settings must not be negative")
+    }
+
+    l := &limits{
+        perEndpoint: options.MaxConnsPerEndpoint,
+        queueSize: int64(options.QueueSize),
+        queueTimeout: time.Duration(options.QueueTimeout) * time.Millisecond,
+        endpoints: make(map[*cycle.Endpoint]int),
+        released: make(chan struct{}),
+        lock: &sync.Mutex{},
+    }
+
+    if options.MaxConns > 0 {
+        l.slots = make(chan struct{}, options.MaxConns)
+    }
+
+    return l, nil
+}
+
+func (l *limits) tryAdmit() bool {
+    if l.slots == nil {
+        return true
+    }
+
+    select {
+    case l.slots <- struct{}{}:
+        return true
+    default:
+        return false
+    }
+}
+
+// Returns false if the queue is full; the queue is shared by the connections waiting for global and endpoint slots
+func (l *limits) enqueue() bool {
+    if atomic.AddInt64(&l.queued, 1) > l.queueSize {
+        atomic.AddInt64(&l.queued, -1)
+        return false
+    }
+    return true
+}
+
+func (l *limits) dequeue() {
+    atomic.AddInt64(&l.queued, -1)
+}
+
+// Must be called after successful enqueue(); returns false on timeout
+func (l *limits) waitAdmit() bool {
+    defer l.dequeue()
+
+    timer := time.NewTimer(l.queueTimeout)
+    defer timer.Stop()
+
+    select {
+    case l.slots <- struct{}{}:
+        return true
+    case <-timer.C:
+        return false
+    }
+}
+
+// Must be called for every admitted connection when it is finished
+func (l *limits) leave() {
+    if l.slots != nil {
+        <-l.slots
+    }
+}
+
+// Extends skip with the endpoints having no free slots
+func (l *limits) skip(skip cycle.Skip) cycle.Skip {
+    if l.perEndpoint <= 0 {
+        return skip
+    }
+
+    return func(endpoint *cycle.Endpoint) bool {
+        return (skip != nil && skip(endpoint)) || l.isFull(endpoint)
+    }
+}
+
+func (l *limits) isFull(endpoint *cycle.Endpoint) bool {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+
+    return l.endpoints[endpoint] >= l.perEndpoint
+}
+
+// Returns nil if the slot is acquired, otherwise the channel closed on the next endpoint slot release;
+// the channel is taken together with the check, so that no release in between is missed
+func (l *limits) acquire(endpoint *cycle.Endpoint) <-chan struct{} {
+    if l.perEndpoint <= 0 {
+        return nil
+    }
+
+    l.lock.Lock()
+    defer l.lock.Unlock()
+
+    if l.endpoints[endpoint] >= l.perEndpoint {
+        return l.released
+    }
+
+    l.endpoints[endpoint]++
+
+    return nil
+}
+
+func (l *limits) release(endpoint *cycle.Endpoint) {
+    if l.perEndpoint <= 0 {
+        return
+    }
+
+    l.lock.Lock()
+    defer l.lock.Unlock()
+
+    if l.endpoints[endpoint] <= 1 {
+        delete(l.endpoints, endpoint)
+    } else {
+        l.endpoints[endpoint]--
+    }
+
+    close(l.released)
+    l.released = make(chan struct{})
+}
+
+// Waits for the channel returned by the failed acquire(); returns false if the deadline is reached first
+func (l *limits) waitRelease(released <-chan struct{}, deadline time.Time) bool {
+    timer := time.NewTimer(deadline.Sub(time.Now()))
+    defer timer.Stop()
+
+    select {
+    case <-released:
+        return true
+    case <-timer.C:
+        return false
+    }
+}
+
+func (l *limits) reject() int64 {
+    return atomic.AddInt64(&l.rejected, 1)
+}
+
+func (l *limits) stats() (int, int64) {
+    return int(atomic.LoadInt64(&l.queued)), atomic.LoadInt64(&l.rejected)
+}
@@ -0,0 +1,207 @@
+package jongleur
+
+import (
+    "bytes"
+    "github.com/maxmanuylov/jongleur/utils/cycle"
+    "io/ioutil"
+    "log"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+func newTestLimits(t *testing.T, perEndpoint int, queueSize int) *limits {
+    options := DefaultOptions()
+    options.MaxConnsPerEndpoint = perEndpoint
+    options.QueueSize = queueSize
+
+    l, err := options.limits()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return l
+}
+
+func TestReleaseBetweenAcquireAndWaitIsNotMissed(t *testing.T) {
+    l := newTestLimits(t, 1, 10)
+    endpoint := &cycle.Endpoint{Host: "a"}
+
+    if l.acquire(endpoint) != nil {
+        t.Fatal("The first slot must be acquired")
+    }
+
+    released := l.acquire(endpoint)
+    if released == nil {
+        t.Fatal("The second slot must not be acquired")
+    }
+
+    l.release(endpoint) // Before the wait starts
+
+    if !l.waitRelease(released, time.Now().Add(time.Second)) {
+        t.Fatal("The release is missed")
+    }
+
+    if l.acquire(endpoint) != nil {
+        t.Fatal("The released slot must be acquired")
+    }
+}
+
+func TestQueueIsBounded(t *testing.T) {
+    l := newTestLimits(t, 1, 2)
+
+    if !l.enqueue() || !l.enqueue() {
+        t.Fatal("Connections within the queue size must be queued")
+    }
+
+    if l.enqueue() {
+        t.Fatal("Connection beyond the queue size must not be queued")
+    }
+
+    l.dequeue()
+
+    if !l.enqueue() {
+        t.Fatal("Connection must be queued after another one leaves the queue")
+    }
+
+    if queued, _ := l.stats(); queued != 2 {
+        t.Errorf("Expected 2 queued connections, got %d", queued)
+    }
+}
+
+// Accepts the connections and keeps them open until closed
+func holdingListener(t *testing.T) net.Listener {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    go func() {
+        var accepted []net.Conn
+        defer func() {
+            for _, connection := range accepted {
+                connection.Close()
+            }
+        }()
+
+        for {
+            connection, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            accepted = append(accepted, connection)
+        }
+    }()
+
+    return listener
+}
+
+func testConfig(backend net.Listener, options *Options) *Config {
+    return &Config{
+        Listen: "127.0.0.1:0",
+        Period: 60,
+        ItemsLoader: func() ([]cycle.Item, error) {
+            return []cycle.Item{{Host: backend.Addr().String(), Weight: 1}}, nil
+        },
+        RequestPatcher: IDENTICAL_PATCHER,
+        ResponsePatcher: IDENTICAL_PATCHER,
+        Options: options,
+    }
+}
+
+// Connects to the proxy and waits for the stats to reach the expected values
+func connectAndWait(t *testing.T, proxy *Proxy, stats func() Stats, expected Stats) net.Conn {
+    client, err := net.Dial("tcp", proxy.listener.(net.Listener).Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    deadline := time.Now().Add(5 * time.Second)
+    for actual := stats(); actual != expected; actual = stats() {
+        if time.Now().After(deadline) {
+            client.Close()
+            t.Fatalf("Expected %+v, got %+v", expected, actual)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    return client
+}
+
+func TestStatsWhenLimitsAreReached(t *testing.T) {
+    backend := holdingListener(t)
+    defer backend.Close()
+
+    options := DefaultOptions()
+    options.MaxConns = 1
+    options.QueueSize = 1
+    options.QueueTimeout = 60000
+    options.DrainTimeout = 1
+
+    logger := log.New(ioutil.Discard, "", 0)
+
+    proxy, err := Start(testConfig(backend, options), logger)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer proxy.Shutdown()
+
+    syncItems(proxy.data.routes, logger) // Items are loaded before the first connection
+
+    // The first connection takes the only slot, the second one waits in the queue and the third one is rejected
+    expected := []Stats{{Active: 1}, {Active: 2, Queued: 1}, {Active: 2, Queued: 1, Rejected: 1}}
+    for _, stats := range expected {
+        defer connectAndWait(t, proxy, proxy.Stats, stats).Close()
+    }
+
+    output := &bytes.Buffer{}
+    reportLogger := log.New(output, "", 0)
+
+    reported := reportStats(proxy.Stats(), Stats{}, reportLogger)
+    if !strings.Contains(output.String(), "2 active, 1 queued, 1 rejected, 0 rate limited") {
+        t.Errorf("Unexpected stats report: %q", output.String())
+    }
+
+    output.Reset()
+
+    if reportStats(proxy.Stats(), reported, reportLogger); output.Len() != 0 {
+        t.Errorf("Unchanged stats are reported again: %q", output.String())
+    }
+}
+
+func TestLimitsAreSharedByGroup(t *testing.T) {
+    backend := holdingListener(t)
+    defer backend.Close()
+
+    options := DefaultOptions()
+    options.MaxConns = 1
+    options.QueueSize = 1
+    options.QueueTimeout = 60000
+    options.DrainTimeout = 1
+
+    // Every route gets its own copy of the options, like the routes of the command line
+    otherOptions := *options
+
+    logger := log.New(ioutil.Discard, "", 0)
+
+    group, err := StartGroup([]*Config{testConfig(backend, options), testConfig(backend, &otherOptions)}, logger)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer group.Shutdown()
+
+    for _, proxy := range group.Proxies {
+        syncItems(proxy.data.routes, logger)
+    }
+
+    first, second := group.Proxies[0], group.Proxies[1]
+
+    // The only slot is taken through the first proxy, so the connections to the second one are queued and rejected
+    defer connectAndWait(t, first, group.Stats, Stats{Active: 1}).Close()
+    defer connectAndWait(t, second, group.Stats, Stats{Active: 2, Queued: 1}).Close()
+    defer connectAndWait(t, second, group.Stats, Stats{Active: 2, Queued: 1, Rejected: 1}).Close()
+
+    if active := second.Stats().Active; active != 1 {
+        t.Errorf("Expected 1 active connection to the second proxy, got %d", active)
+    }
+}
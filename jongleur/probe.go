@@ -0,0 +1,198 @@
+package jongleur
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "github.com/maxmanuylov/jongleur/utils/cycle"
+    "io"
+    "strconv"
+    "sync"
+    "time"
+)
+
+type probeConfig struct {
+    interval time.Duration
+    timeout  time.Duration
+    send     []byte
+    expect   []byte
+    rise     int
+    fall     int
+}
+
+type probeState struct {
+    endpoint  *cycle.Endpoint
+    down      bool
+    successes int
+    failures  int
+}
+
+// Active health checks: every endpoint is periodically connected to (and optionally talked to);
+// it is marked down after "fall" failed probes in a row and up again after "rise" successful ones
+type prober struct {
+    config *probeConfig
+    data   *runtimeData
+    picker *cycle.Picker
+    states map[string]*probeState
+}
+
+func runProber(data *runtimeData, picker *cycle.Picker) {
+    p := &prober{
+        config: data.probe,
+        data: data,
+        picker: picker,
+        states: make(map[string]*probeState),
+    }
+
+    ticker := time.NewTicker(p.config.interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            p.probeAll()
+        case <-data.stop:
+            return
+        }
+    }
+}
+
+func (p *prober) probeAll() {
+    var endpoints []*cycle.Endpoint
+    for _, endpoint := range p.picker.Endpoints() {
+        if !isAnyPortHost(endpoint.Host) { // There is no port to probe
+            endpoints = append(endpoints, endpoint)
+        }
+    }
+
+    states := make(map[string]*probeState)
+    for _, endpoint := range endpoints {
+        state, ok := p.states[endpoint.Host]
+        if !ok || state.endpoint != endpoint {
+            state = &probeState{endpoint: endpoint}
+        }
+        states[endpoint.Host] = state
+    }
+    p.states = states
+
+    results := make([]error, len(endpoints))
+
+    var wg sync.WaitGroup
+    for i, endpoint := range endpoints {
+        wg.Add(1)
+        go func(i int, host string) {
+            defer wg.Done()
+            results[i] = p.probe(host)
+        }(i, endpoint.Host)
+    }
+    wg.Wait()
+
+    for i, endpoint := range endpoints {
+        p.update(states[endpoint.Host], results[i])
+    }
+}
+
+func (p *prober) probe(host string) error {
+    conn, err := dialService(host, p.config.timeout)
+    if err != nil {
+        return err
+    }
+
+    defer conn.Close()
+
+    if len(p.config.send) == 0 && len(p.config.expect) == 0 {
+        return nil
+    }
+
+    if err := conn.SetDeadline(time.Now().Add(p.config.timeout)); err != nil {
+        return err
+    }
+
+    if len(p.config.send) != 0 {
+        if _, err := conn.Write(p.config.send); err != nil {
+            return err
+        }
+    }
+
+    if len(p.config.expect) != 0 {
+        response := make([]byte, len(p.config.expect))
+        if _, err := io.ReadFull(conn, response); err != nil {
+            return err
+        }
+
+        if !bytes.Equal(response, p.config.expect) {
+            return fmt.Errorf("Unexpected response: %q", response)
+        }
+    }
+
+    return nil
+}
+
+func (p *prober) update(state *probeState, err error) {
+    if err == nil {
+        state.successes++
+        state.failures = 0
+    } else {
+        state.failures++
+        state.successes = 0
+    }
+
+    logger := p.data.logger
+
+    if state.down && state.successes >= p.config.rise {
+        state.down = false
+        logger.Printf("Endpoint %s is up after %d successful probes\n", state.endpoint.Host, state.successes)
+    } else if !state.down && state.failures >= p.config.fall {
+        state.down = true
+        logger.Printf("Endpoint %s is down after %d failed probes: %s\n", state.endpoint.Host, state.failures, err.Error())
+    } else {
+        if err != nil && p.data.verbose {
+            logger.Printf("Probe of endpoint %s failed: %s\n", state.endpoint.Host, err.Error())
+        }
+        return
+    }
+
+    p.picker.SetDown(state.endpoint, state.down)
+}
+
+func (options *Options) probeConfig() (*probeConfig, error) {
+    if options.ProbeInterval <= 0 {
+        return nil, nil
+    }
+
+    if options.ProbeTimeout <= 0 {
+        return nil, errors.New("Probe timeout must be positive")
+    }
+
+    if options.ProbeRise <= 0 || options.ProbeFall <= 0 {
+        return nil, errors.New("Probe rise and fall thresholds must be positive")
+    }
+
+    send, err := unescape(options.ProbeSend)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid probe data to send: %v", err)
+    }
+
+    expect, err := unescape(options.ProbeExpect)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid expected probe response: %v", err)
+    }
+
+    return &probeConfig{
+        interval: time.Duration(options.ProbeInterval) * time.Second,
+        timeout: time.Duration(options.ProbeTimeout) * time.Second,
+        send: send,
+        expect: expect,
+        rise: options.ProbeRise,
+        fall: options.ProbeFall,
+    }, nil
+}
+
+// Go escape sequences like "\r\n" or "\x00" are supported to allow binary protocols
+func unescape(s string) ([]byte, error) {
+    unquoted, err := strconv.Unquote("\"" + s + "\"")
+    if err != nil {
+        return nil, err
+    }
+    return []byte(unquoted), nil
+}
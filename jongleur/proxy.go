@@ -1,9 +1,13 @@
 package jongleur
 
 import (
+    "crypto/tls"
     "errors"
+    "fmt"
+    "github.com/maxmanuylov/jongleur/utils/cycle"
     "io"
     "net"
+    "strings"
     "time"
 )
 
@@ -14,6 +18,7 @@ type WriteCloseableConn interface {
 
 var _ WriteCloseableConn = (*net.TCPConn)(nil)
 var _ WriteCloseableConn = (*net.UnixConn)(nil)
+var _ WriteCloseableConn = (*tls.Conn)(nil)
 
 const serviceUnavailable = "HTTP/1.1 503 Service unavailable\n"
 
@@ -22,17 +27,137 @@ func runProxy(listener net.Listener, data *runtimeData) {
     for {
         connection, err := listener.Accept()
         if err != nil {
-            data.logger.Printf("[Server] %s\n", err.Error())
+            select {
+            case <-data.stop:
+            default:
+                data.logger.Printf("[Server] %s\n", err.Error())
+            }
             return
         }
         n++
-        go handleConnection(connection, data, n)
+
+        if data.proxyTrust != nil {
+            data.connections.add(n, connection, nil) // Replaced on admission; until then it is only closed on shutdown
+            go acceptProxiedConnection(connection, listener.Addr(), data, n)
+        } else {
+            admitDirectConnection(connection, listener.Addr(), data, n)
+        }
+    }
+}
+
+// Connections without the original destination from a trusted PROXY header must be redirected in transparent mode
+func admitDirectConnection(connection net.Conn, listenAddr net.Addr, data *runtimeData, n int64) {
+    if data.transparent {
+        redirected, err := redirectedConnection(connection, listenAddr)
+        if err != nil {
+            data.logger.Printf("[%d] Connection from %+v is rejected: %s\n", n, connection.RemoteAddr(), err.Error())
+            connection.Close()
+            data.connections.remove(n)
+            return
+        }
+        connection = redirected
+    }
+
+    admitConnection(connection, data, n)
+}
+
+// Replaces the connection addresses with the ones from the PROXY protocol header if the connection source is trusted;
+// the connection must be added to the active ones before
+func acceptProxiedConnection(clientConnection net.Conn, listenAddr net.Addr, data *runtimeData, n int64) {
+    conn, ok := clientConnection.(WriteCloseableConn)
+    if !ok {
+        admitDirectConnection(clientConnection, listenAddr, data, n)
+        return
+    }
+
+    clientConnection.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+
+    source, destination, err := readProxyHeader(clientConnection)
+    if err != nil {
+        select {
+        case <-data.stop: // Closed on shutdown
+        default:
+            data.logger.Printf("[%d] Failed to read PROXY header from %+v: %s\n", n, clientConnection.RemoteAddr(), err.Error())
+        }
+        clientConnection.Close()
+        data.connections.remove(n)
+        return
+    }
+
+    clientConnection.SetReadDeadline(time.Time{})
+
+    if source == nil {
+        admitDirectConnection(clientConnection, listenAddr, data, n)
+        return
+    }
+
+    if !data.proxyTrust.trusts(clientConnection.RemoteAddr()) {
+        data.logger.Printf("[%d] PROXY header from untrusted source %+v is ignored\n", n, clientConnection.RemoteAddr())
+        admitDirectConnection(clientConnection, listenAddr, data, n)
+        return
+    }
+
+    if data.verbose {
+        data.logger.Printf("[%d] Connection from %+v is proxied for %+v\n", n, clientConnection.RemoteAddr(), source)
+    }
+
+    admitConnection(&proxiedConn{conn, source, destination}, data, n)
+}
+
+func admitConnection(clientConnection net.Conn, data *runtimeData, n int64) {
+    release, err := data.clientLimits.admit(clientConnection.RemoteAddr())
+    if err != nil {
+        data.connections.add(n, clientConnection, nil)
+        rejectConnection(clientConnection, data, n, fmt.Sprintf("%s (%d rate limited in total)", err.Error(), data.clientLimits.reject()))
+        return
+    }
+
+    data.connections.add(n, clientConnection, release)
+
+    if data.limits.tryAdmit() {
+        go handleConnection(clientConnection, data, n)
+    } else if data.limits.enqueue() {
+        go handleQueuedConnection(clientConnection, data, n)
+    } else {
+        rejectConnection(clientConnection, data, n, fmt.Sprintf("queue is full (%d rejected in total)", data.limits.reject()))
+    }
+}
+
+func handleQueuedConnection(clientConnection net.Conn, data *runtimeData, n int64) {
+    if data.verbose {
+        data.logger.Printf("[%d] Connection limit is reached, queued\n", n)
+    }
+
+    if data.limits.waitAdmit() {
+        handleConnection(clientConnection, data, n)
+    } else {
+        rejectConnection(clientConnection, data, n, fmt.Sprintf("queue timeout expired (%d rejected in total)", data.limits.reject()))
     }
 }
 
+func rejectConnection(clientConnection net.Conn, data *runtimeData, n int64, reason string) {
+    defer data.connections.remove(n)
+    defer clientConnection.Close()
+
+    data.logger.Printf("[%d] Connection from %+v is rejected: %s\n", n, clientConnection.RemoteAddr(), reason)
+
+    clientConnection.Write([]byte(serviceUnavailable))
+}
+
 func handleConnection(clientConnection net.Conn, data *runtimeData, n int64) {
+    defer data.limits.leave()
+    defer data.connections.remove(n)
     defer clientConnection.Close()
 
+    if data.tls != nil {
+        tlsConnection, err := data.tls.handshake(clientConnection)
+        if err != nil {
+            data.logger.Printf("[%d] TLS handshake with %+v failed: %s\n", n, clientConnection.RemoteAddr(), err.Error())
+            return
+        }
+        clientConnection = tlsConnection
+    }
+
     if conn, ok := clientConnection.(WriteCloseableConn); ok {
         doHandleConnection(conn, data, n)
         return
@@ -46,8 +171,40 @@ func doHandleConnection(clientConnection WriteCloseableConn, data *runtimeData,
         data.logger.Printf("[%d] Accepted connection from %+v\n", n, clientConnection.RemoteAddr())
     }
 
-    for i := 0; i < 10; i++ {
-        host, err := nextHost(data)
+    route, routedConnection, err := selectRoute(clientConnection, data, n)
+    if err != nil {
+        data.logger.Printf("[%d] Failed to read TLS ClientHello from %+v: %s\n", n, clientConnection.RemoteAddr(), err.Error())
+        return
+    }
+
+    clientConnection = routedConnection
+
+    policy := data.connectPolicy
+    deadline := policy.deadlineFrom(time.Now())
+
+    // Endpoints that already failed are not retried while there are untried ones
+    tried := make(map[*cycle.Endpoint]bool)
+    skipTried := func(endpoint *cycle.Endpoint) bool {
+        return tried[endpoint]
+    }
+
+    for i := 0; i < policy.attempts; i++ {
+        delay, timeout := policy.schedule(i, deadline)
+        if timeout <= 0 {
+            if data.verbose {
+                data.logger.Printf("[%d] Connect deadline is exceeded\n", n)
+            }
+            break
+        }
+
+        time.Sleep(delay)
+
+        var skip cycle.Skip
+        if len(tried) != 0 {
+            skip = skipTried
+        }
+
+        endpoint, err := acquireEndpoint(clientConnection.RemoteAddr(), skip, route, data, n)
         if err != nil {
             clientConnection.Write([]byte(err.Error()))
             if data.verbose {
@@ -57,12 +214,17 @@ func doHandleConnection(clientConnection WriteCloseableConn, data *runtimeData,
         }
 
         if data.verbose {
-            data.logger.Printf("[%d] Attempt #%d. Endpoint: %s\n", n, i + 1, host)
+            data.logger.Printf("[%d] Attempt #%d. Endpoint: %s\n", n, i + 1, endpoint.Host)
         }
 
-        serviceConnection, err := dialTCP(host, 2 * time.Second)
+        dialStart := time.Now()
+
+        serviceConnection, err := dialEndpoint(clientConnection, endpoint, timeout, data)
         if err != nil {
-            data.logger.Printf("[%d] Connection to endpoint \"%s\" failed: %s\n", n, host, err.Error())
+            data.logger.Printf("[%d] Connection to endpoint \"%s\" failed: %s\n", n, endpoint.Host, err.Error())
+            route.picker.Failed(endpoint)
+            data.limits.release(endpoint)
+            tried[endpoint] = true
             continue
         }
 
@@ -70,7 +232,13 @@ func doHandleConnection(clientConnection WriteCloseableConn, data *runtimeData,
             data.logger.Printf("[%d] Connected successfully, transferring data...\n", n)
         }
 
-        link(clientConnection, serviceConnection, data)
+        route.picker.Connected(endpoint, time.Since(dialStart))
+        data.connections.attach(n, serviceConnection)
+
+        link(clientConnection, serviceConnection, data, n)
+
+        route.picker.Disconnected(endpoint)
+        data.limits.release(endpoint)
 
         if data.verbose {
             data.logger.Printf("[%d] Data is successfully transferred\n", n)
@@ -86,37 +254,142 @@ func doHandleConnection(clientConnection WriteCloseableConn, data *runtimeData,
     clientConnection.Write([]byte(serviceUnavailable))
 }
 
-func nextHost(data *runtimeData) (string, error) {
-    select {
-    case host := <-data.hosts:
-        return host, nil
-    case <-time.After(time.Second):
-        return "", errors.New(serviceUnavailable)
+// Picks an endpoint having a free connection slot; waits for a slot if all the endpoints are at their limits
+func acquireEndpoint(clientAddr net.Addr, skip cycle.Skip, route *route, data *runtimeData, n int64) (*cycle.Endpoint, error) {
+    var queueDeadline time.Time
+
+    for {
+        endpoint, err := nextEndpoint(clientAddr, data.limits.skip(skip), route)
+        if err != nil {
+            return nil, err
+        }
+
+        released := data.limits.acquire(endpoint)
+        if released == nil {
+            return endpoint, nil
+        }
+
+        if queueDeadline.IsZero() {
+            if !data.limits.enqueue() {
+                rejected := data.limits.reject()
+                data.logger.Printf("[%d] Connection from %+v is rejected: all endpoints are at their connection limits and queue is full (%d rejected in total)\n", n, clientAddr, rejected)
+                return nil, errors.New(serviceUnavailable)
+            }
+            defer data.limits.dequeue()
+
+            queueDeadline = time.Now().Add(data.limits.queueTimeout)
+
+            if data.verbose {
+                data.logger.Printf("[%d] All endpoints are at their connection limits, queued\n", n)
+            }
+        }
+
+        if !data.limits.waitRelease(released, queueDeadline) {
+            rejected := data.limits.reject()
+            data.logger.Printf("[%d] Connection from %+v is rejected: all endpoints are at their connection limits (%d rejected in total)\n", n, clientAddr, rejected)
+            return nil, errors.New(serviceUnavailable)
+        }
+    }
+}
+
+func nextEndpoint(clientAddr net.Addr, skip cycle.Skip, route *route) (*cycle.Endpoint, error) {
+    if endpoint := route.picker.Pick(clientKey(clientAddr), skip); endpoint != nil {
+        return endpoint, nil
     }
+    return nil, errors.New(serviceUnavailable)
 }
 
-func dialTCP(host string, timeout time.Duration) (*net.TCPConn, error) {
-    conn, err := net.DialTimeout("tcp", host, timeout)
+// Client port changes on every reconnect, so only IP identifies the client
+func clientKey(clientAddr net.Addr) string {
+    if ip := clientIP(clientAddr); ip != nil {
+        return ip.String()
+    }
+    return clientAddr.String()
+}
+
+// Returns nil for the clients having no IP, e.g. unix socket ones
+func clientIP(clientAddr net.Addr) net.IP {
+    switch addr := clientAddr.(type) {
+    case *net.TCPAddr:
+        return addr.IP
+    case *net.UDPAddr:
+        return addr.IP
+    default:
+        return nil
+    }
+}
+
+// Dials the endpoint, sends the PROXY protocol header and performs the TLS handshake as configured
+func dialEndpoint(clientConnection net.Conn, endpoint *cycle.Endpoint, timeout time.Duration, data *runtimeData) (WriteCloseableConn, error) {
+    deadline := time.Now().Add(timeout)
+
+    host, err := resolveHost(endpoint.Host, clientConnection)
+    if err != nil {
+        return nil, err
+    }
+
+    serviceConnection, err := dialService(host, timeout)
     if err != nil {
         return nil, err
     }
 
-    tcpConn, ok := conn.(*net.TCPConn)
+    if data.sendProxy != "" {
+        if err := writeProxyHeader(serviceConnection, data.sendProxy, clientConnection.RemoteAddr(), clientConnection.LocalAddr()); err != nil {
+            serviceConnection.Close()
+            return nil, fmt.Errorf("Failed to send PROXY header: %v", err)
+        }
+    }
+
+    if data.backendTLS == nil {
+        return serviceConnection, nil
+    }
+
+    tlsConnection, err := data.backendTLS.handshake(serviceConnection, endpoint, deadline)
+    if err != nil {
+        serviceConnection.Close()
+        return nil, fmt.Errorf("TLS handshake failed: %v", err)
+    }
+
+    return tlsConnection, nil
+}
+
+// Endpoint host is either "<host>:<port>" or "unix@<socket path>"
+func dialService(host string, timeout time.Duration) (WriteCloseableConn, error) {
+    network, addr := SplitNetAddr(host)
+    if !strings.HasPrefix(network, "tcp") && !strings.HasPrefix(network, "unix") {
+        return nil, fmt.Errorf("Unsupported endpoint network: \"%s\"", network)
+    }
+
+    conn, err := net.DialTimeout(network, addr, timeout)
+    if err != nil {
+        return nil, err
+    }
+
+    serviceConn, ok := conn.(WriteCloseableConn)
     if !ok {
         defer conn.Close()
-        return nil, errors.New("Not a TCP connection")
+        return nil, errors.New("Not a stream connection")
     }
 
-    return tcpConn, nil
+    return serviceConn, nil
 }
 
-func link(clientConnection WriteCloseableConn, serviceConnection WriteCloseableConn, data *runtimeData) {
+func link(clientConnection WriteCloseableConn, serviceConnection WriteCloseableConn, data *runtimeData, n int64) {
     defer serviceConnection.Close()
 
+    var clientReader, serviceReader io.Reader = clientConnection, serviceConnection
+
+    if watchdog := watchLink(clientConnection, serviceConnection, data, n); watchdog != nil {
+        defer watchdog.stop()
+
+        clientReader = watchdog.reader(clientConnection)
+        serviceReader = watchdog.reader(serviceConnection)
+    }
+
     done := make(chan bool, 2)
 
-    go copyStream(clientConnection, serviceConnection, data.requestPatcher, done)
-    go copyStream(serviceConnection, clientConnection, data.responsePatcher, done)
+    go copyStream(clientReader, serviceConnection, data.requestPatcher, done)
+    go copyStream(serviceReader, clientConnection, data.responsePatcher, done)
 
     <-done
     <-done
@@ -0,0 +1,322 @@
+package jongleur
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// PROXY protocol versions, see http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+const (
+    ProxyProtocolV1 = "v1"
+    ProxyProtocolV2 = "v2"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+    proxyHeaderTimeout = 5 * time.Second
+    proxyV1MaxLength   = 107
+)
+
+const (
+    proxyV2Local  = 0x20
+    proxyV2Proxy  = 0x21
+    proxyV2TCP4   = 0x11
+    proxyV2TCP6   = 0x21
+    proxyV2Unspec = 0x00
+)
+
+func checkProxyProtocol(version string) error {
+    switch version {
+    case "", ProxyProtocolV1, ProxyProtocolV2:
+        return nil
+    default:
+        return fmt.Errorf("Unknown PROXY protocol version: \"%s\"", version)
+    }
+}
+
+// Writes the PROXY protocol header describing the client connection; source and destination addresses
+// that are not TCP ones are sent as unknown
+func writeProxyHeader(to io.Writer, version string, source net.Addr, destination net.Addr) error {
+    var header []byte
+    if version == ProxyProtocolV2 {
+        header = proxyHeaderV2(source, destination)
+    } else {
+        header = proxyHeaderV1(source, destination)
+    }
+
+    _, err := to.Write(header)
+    return err
+}
+
+func proxyHeaderV1(source net.Addr, destination net.Addr) []byte {
+    sourceIP, sourcePort, destinationIP, destinationPort, ok := proxyAddrs(source, destination)
+    if !ok {
+        return []byte("PROXY UNKNOWN\r\n")
+    }
+
+    family := "TCP4"
+    if len(sourceIP) == net.IPv6len {
+        family = "TCP6"
+    }
+
+    return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, formatProxyIP(sourceIP), formatProxyIP(destinationIP), sourcePort, destinationPort))
+}
+
+// IPv4-mapped addresses are formatted as IPv6 ones, since both addresses must be of the header family
+func formatProxyIP(ip net.IP) string {
+    if len(ip) == net.IPv6len && ip.To4() != nil {
+        return "::ffff:" + ip.To4().String()
+    }
+    return ip.String()
+}
+
+func proxyHeaderV2(source net.Addr, destination net.Addr) []byte {
+    header := &bytes.Buffer{}
+    header.Write(proxyV2Signature)
+
+    sourceIP, sourcePort, destinationIP, destinationPort, ok := proxyAddrs(source, destination)
+    if !ok {
+        header.Write([]byte{proxyV2Local, proxyV2Unspec, 0, 0})
+        return header.Bytes()
+    }
+
+    if len(sourceIP) == net.IPv4len {
+        header.Write([]byte{proxyV2Proxy, proxyV2TCP4, 0, 12})
+    } else {
+        header.Write([]byte{proxyV2Proxy, proxyV2TCP6, 0, 36})
+    }
+
+    header.Write(sourceIP)
+    header.Write(destinationIP)
+    binary.Write(header, binary.BigEndian, uint16(sourcePort))
+    binary.Write(header, binary.BigEndian, uint16(destinationPort))
+
+    return header.Bytes()
+}
+
+// Both addresses are returned in the same family, i.e. of the same length; IPv4 ones are mapped to IPv6 if the other
+// address is IPv6
+func proxyAddrs(source net.Addr, destination net.Addr) (net.IP, int, net.IP, int, bool) {
+    sourceTCP, ok := source.(*net.TCPAddr)
+    if !ok {
+        return nil, 0, nil, 0, false
+    }
+
+    destinationTCP, ok := destination.(*net.TCPAddr)
+    if !ok {
+        return nil, 0, nil, 0, false
+    }
+
+    sourceIP, destinationIP := sourceTCP.IP.To4(), destinationTCP.IP.To4()
+    if sourceIP == nil || destinationIP == nil {
+        sourceIP, destinationIP = sourceTCP.IP.To16(), destinationTCP.IP.To16()
+    }
+
+    if sourceIP == nil || destinationIP == nil {
+        return nil, 0, nil, 0, false
+    }
+
+    return sourceIP, sourceTCP.Port, destinationIP, destinationTCP.Port, true
+}
+
+// Client connection with the addresses taken from the received PROXY protocol header
+type proxiedConn struct {
+    WriteCloseableConn
+    source      net.Addr
+    destination net.Addr
+}
+
+func (conn *proxiedConn) RemoteAddr() net.Addr {
+    return conn.source
+}
+
+func (conn *proxiedConn) LocalAddr() net.Addr {
+    return conn.destination
+}
+
+// Sources PROXY protocol headers are accepted from
+type proxyTrust struct {
+    networks []*net.IPNet // Empty list means that all the sources are trusted
+}
+
+func (options *Options) proxyTrust() (*proxyTrust, error) {
+    if !options.AcceptProxy {
+        return nil, nil
+    }
+
+    trust := &proxyTrust{}
+
+    for _, cidr := range strings.Split(options.ProxyTrusted, ",") {
+        if cidr = strings.TrimSpace(cidr); cidr == "" {
+            continue
+        }
+
+        if !strings.Contains(cidr, "/") {
+            if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+                cidr += "/32"
+            } else {
+                cidr += "/128"
+            }
+        }
+
+        _, network, err := net.ParseCIDR(cidr)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid trusted PROXY protocol source \"%s\": %v", cidr, err)
+        }
+
+        trust.networks = append(trust.networks, network)
+    }
+
+    return trust, nil
+}
+
+func (trust *proxyTrust) trusts(addr net.Addr) bool {
+    if len(trust.networks) == 0 {
+        return true
+    }
+
+    tcpAddr, ok := addr.(*net.TCPAddr)
+    if !ok {
+        return false
+    }
+
+    for _, network := range trust.networks {
+        if network.Contains(tcpAddr.IP) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Reads the PROXY protocol header of any version; the returned addresses are nil if the header carries no addresses.
+// Nothing beyond the header is read from the connection.
+func readProxyHeader(from io.Reader) (net.Addr, net.Addr, error) {
+    prefix := make([]byte, 6)
+    if _, err := io.ReadFull(from, prefix); err != nil {
+        return nil, nil, err
+    }
+
+    if string(prefix) == "PROXY " {
+        return readProxyHeaderV1(from)
+    }
+
+    if bytes.Equal(prefix, proxyV2Signature[:len(prefix)]) {
+        return readProxyHeaderV2(from, prefix)
+    }
+
+    return nil, nil, errors.New("No PROXY protocol header")
+}
+
+func readProxyHeaderV1(from io.Reader) (net.Addr, net.Addr, error) {
+    line := make([]byte, 0, proxyV1MaxLength)
+    next := make([]byte, 1)
+
+    for !bytes.HasSuffix(line, []byte("\r\n")) {
+        if len(line) >= proxyV1MaxLength {
+            return nil, nil, errors.New("PROXY protocol v1 header is too long")
+        }
+
+        if _, err := io.ReadFull(from, next); err != nil {
+            return nil, nil, err
+        }
+
+        line = append(line, next[0])
+    }
+
+    fields := strings.Split(string(line[:len(line) - 2]), " ")
+
+    if fields[0] == "UNKNOWN" {
+        return nil, nil, nil
+    }
+
+    if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+        return nil, nil, fmt.Errorf("Invalid PROXY protocol v1 header: \"%s\"", string(line[:len(line) - 2]))
+    }
+
+    source, err := parseProxyAddr(fields[1], fields[3])
+    if err != nil {
+        return nil, nil, err
+    }
+
+    destination, err := parseProxyAddr(fields[2], fields[4])
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return source, destination, nil
+}
+
+func parseProxyAddr(ipStr string, portStr string) (*net.TCPAddr, error) {
+    ip := net.ParseIP(ipStr)
+    if ip == nil {
+        return nil, fmt.Errorf("Invalid PROXY protocol address: \"%s\"", ipStr)
+    }
+
+    port, err := strconv.ParseUint(portStr, 10, 16)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid PROXY protocol port: \"%s\"", portStr)
+    }
+
+    return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(from io.Reader, prefix []byte) (net.Addr, net.Addr, error) {
+    header := make([]byte, 16)
+    copy(header, prefix)
+
+    if _, err := io.ReadFull(from, header[len(prefix):]); err != nil {
+        return nil, nil, err
+    }
+
+    if !bytes.Equal(header[:12], proxyV2Signature) || header[12] >> 4 != 2 {
+        return nil, nil, errors.New("Invalid PROXY protocol v2 header")
+    }
+
+    payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+    if _, err := io.ReadFull(from, payload); err != nil {
+        return nil, nil, err
+    }
+
+    if header[12] == proxyV2Local {
+        return nil, nil, nil
+    }
+
+    if header[12] != proxyV2Proxy {
+        return nil, nil, fmt.Errorf("Unknown PROXY protocol v2 command: %#x", header[12])
+    }
+
+    var ipLength int
+    switch header[13] {
+    case proxyV2TCP4:
+        ipLength = net.IPv4len
+    case proxyV2TCP6:
+        ipLength = net.IPv6len
+    default:
+        return nil, nil, nil // Unsupported family, the addresses are ignored
+    }
+
+    if len(payload) < 2 * ipLength + 4 {
+        return nil, nil, errors.New("PROXY protocol v2 addresses are truncated")
+    }
+
+    source := &net.TCPAddr{
+        IP: net.IP(payload[:ipLength]),
+        Port: int(binary.BigEndian.Uint16(payload[2 * ipLength:])),
+    }
+
+    destination := &net.TCPAddr{
+        IP: net.IP(payload[ipLength:2 * ipLength]),
+        Port: int(binary.BigEndian.Uint16(payload[2 * ipLength + 2:])),
+    }
+
+    return source, destination, nil
+}
@@ -0,0 +1,145 @@
+package jongleur
+
+import (
+    "bytes"
+    "io/ioutil"
+    "net"
+    "strings"
+    "testing"
+)
+
+func proxyV2Header(command byte, family byte, payload []byte) string {
+    header := append([]byte{}, proxyV2Signature...)
+    header = append(header, command, family, byte(len(payload) >> 8), byte(len(payload)))
+    return string(append(header, payload...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+    tcp4Payload := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x03, 0xE8, 0x07, 0xD0}
+    tcp6Payload := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("::1")...), 0x03, 0xE8, 0x07, 0xD0)
+
+    tests := []struct {
+        name        string
+        input       string
+        source      string // Empty if no addresses are expected
+        destination string
+        fails       bool
+    }{
+        {"v1 TCP4", "PROXY TCP4 1.2.3.4 5.6.7.8 1000 2000\r\n", "1.2.3.4:1000", "5.6.7.8:2000", false},
+        {"v1 TCP6", "PROXY TCP6 2001:db8::1 ::1 1000 2000\r\n", "[2001:db8::1]:1000", "[::1]:2000", false},
+        {"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", "", false},
+        {"v1 UNKNOWN with addresses", "PROXY UNKNOWN 1.2.3.4 5.6.7.8 1000 2000\r\n", "", "", false},
+        {"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", "", true},
+        {"v1 unterminated", "PROXY TCP4 1.2.3.4 5.6.7.8 1000 2000", "", "", true},
+        {"v1 missing fields", "PROXY TCP4 1.2.3.4 5.6.7.8 1000\r\n", "", "", true},
+        {"v1 unknown family", "PROXY UDP4 1.2.3.4 5.6.7.8 1000 2000\r\n", "", "", true},
+        {"v1 invalid address", "PROXY TCP4 1.2.3 5.6.7.8 1000 2000\r\n", "", "", true},
+        {"v1 invalid port", "PROXY TCP4 1.2.3.4 5.6.7.8 1000 70000\r\n", "", "", true},
+        {"v2 TCP4", proxyV2Header(proxyV2Proxy, proxyV2TCP4, tcp4Payload), "1.2.3.4:1000", "5.6.7.8:2000", false},
+        {"v2 TCP6", proxyV2Header(proxyV2Proxy, proxyV2TCP6, tcp6Payload), "[2001:db8::1]:1000", "[::1]:2000", false},
+        {"v2 LOCAL", proxyV2Header(proxyV2Local, proxyV2Unspec, nil), "", "", false},
+        {"v2 LOCAL with payload", proxyV2Header(proxyV2Local, proxyV2TCP4, tcp4Payload), "", "", false},
+        {"v2 unsupported family", proxyV2Header(proxyV2Proxy, 0x31, make([]byte, 216)), "", "", false},
+        {"v2 truncated addresses", proxyV2Header(proxyV2Proxy, proxyV2TCP4, tcp4Payload[:8]), "", "", true},
+        {"v2 unknown command", proxyV2Header(0x2F, proxyV2TCP4, tcp4Payload), "", "", true},
+        {"v2 unknown version", proxyV2Header(0x11, proxyV2TCP4, tcp4Payload), "", "", true},
+        {"no header", "GET / HTTP/1.1\r\n\r\n", "", "", true},
+        {"short input", "PRO", "", "", true},
+    }
+
+    for _, test := range tests {
+        const rest = "payload after the header"
+        reader := bytes.NewReader([]byte(test.input + rest))
+
+        source, destination, err := readProxyHeader(reader)
+
+        if test.fails {
+            if err == nil {
+                t.Errorf("%s: expected an error, got %v and %v", test.name, source, destination)
+            }
+            continue
+        }
+
+        if err != nil {
+            t.Errorf("%s: unexpected error: %v", test.name, err)
+            continue
+        }
+
+        if test.source == "" {
+            if source != nil || destination != nil {
+                t.Errorf("%s: expected no addresses, got %v and %v", test.name, source, destination)
+            }
+        } else if source == nil || destination == nil || source.String() != test.source || destination.String() != test.destination {
+            t.Errorf("%s: expected %s and %s, got %v and %v", test.name, test.source, test.destination, source, destination)
+        }
+
+        if remaining, _ := ioutil.ReadAll(reader); string(remaining) != rest {
+            t.Errorf("%s: bytes after the header are consumed, %q is left", test.name, remaining)
+        }
+    }
+}
+
+func TestReadProxyHeaderFromTruncatedStream(t *testing.T) {
+    headers := []string{
+        "PROXY TCP4 1.2.3.4 5.6.7.8 1000 2000\r\n",
+        proxyV2Header(proxyV2Proxy, proxyV2TCP4, []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x03, 0xE8, 0x07, 0xD0}),
+    }
+
+    for _, header := range headers {
+        for length := 0; length < len(header); length++ {
+            if _, _, err := readProxyHeader(strings.NewReader(header[:length])); err == nil {
+                t.Errorf("Expected an error for %q", header[:length])
+            }
+        }
+    }
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+    tests := []struct {
+        source      string
+        destination string
+    }{
+        {"1.2.3.4:1000", "5.6.7.8:2000"},
+        {"[2001:db8::1]:1000", "[::1]:2000"},
+        {"1.2.3.4:1000", "[::1]:2000"}, // Mixed families are sent as IPv6
+    }
+
+    for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+        for _, test := range tests {
+            source, _ := net.ResolveTCPAddr("tcp", test.source)
+            destination, _ := net.ResolveTCPAddr("tcp", test.destination)
+
+            header := &bytes.Buffer{}
+            if err := writeProxyHeader(header, version, source, destination); err != nil {
+                t.Fatal(err)
+            }
+
+            readSource, readDestination, err := readProxyHeader(header)
+            if err != nil {
+                t.Errorf("%s %s -> %s: %v", version, test.source, test.destination, err)
+                continue
+            }
+
+            readSourceTCP, readDestinationTCP := readSource.(*net.TCPAddr), readDestination.(*net.TCPAddr)
+
+            if !readSourceTCP.IP.Equal(source.IP) || readSourceTCP.Port != source.Port ||
+                !readDestinationTCP.IP.Equal(destination.IP) || readDestinationTCP.Port != destination.Port {
+                t.Errorf("%s %s -> %s: got %v -> %v", version, test.source, test.destination, readSource, readDestination)
+            }
+        }
+    }
+}
+
+func TestProxyHeaderWithoutAddresses(t *testing.T) {
+    source := &net.UnixAddr{Name: "/tmp/client.sock", Net: "unix"}
+    destination := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 80}
+
+    if header := string(proxyHeaderV1(source, destination)); header != "PROXY UNKNOWN\r\n" {
+        t.Errorf("Unexpected v1 header: %q", header)
+    }
+
+    readSource, readDestination, err := readProxyHeader(bytes.NewReader(proxyHeaderV2(source, destination)))
+    if err != nil || readSource != nil || readDestination != nil {
+        t.Errorf("Expected v2 header without addresses, got %v, %v, %v", readSource, readDestination, err)
+    }
+}
@@ -2,39 +2,224 @@ package regular
 
 import (
     "errors"
+    "fmt"
     etcd "github.com/coreos/etcd/client"
     "github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
     "github.com/maxmanuylov/jongleur/jongleur"
     "github.com/maxmanuylov/jongleur/utils"
+    "github.com/maxmanuylov/jongleur/utils/cycle"
     "github.com/maxmanuylov/jongleur/utils/etcd"
+    "io/ioutil"
+    "net"
     "strconv"
     "strings"
 )
 
 type Config struct {
     Verbose    bool
-    Items      string
-    Listen     string
+    Items      *utils.StringHolder // Items and listen can be empty if there are other routes
+    Listen     *utils.StringHolder
+    Routes     *RepeatedFlag // "<listen>=<items>"
+    RoutesFile *utils.StringHolder // File with "<listen>=<items>" line per route
     RemotePort int
     Period     int
     Etcd       string
+    SNIRoutes  *RepeatedFlag // "<server name>=<items>"; applied to the listen address only
+    Options    *jongleur.Options
 }
 
+type RepeatedFlag struct {
+    Values []string
+}
+
+func (flag *RepeatedFlag) String() string {
+    return strings.Join(flag.Values, ",")
+}
+
+func (flag *RepeatedFlag) Set(value string) error {
+    flag.Values = append(flag.Values, value)
+    return nil
+}
+
+// Requires exactly one route
 func (config *Config) ToJongleurConfig() (*jongleur.Config, error) {
+    jongleurConfigs, err := config.ToJongleurConfigs()
+    if err != nil {
+        return nil, err
+    }
+
+    if len(jongleurConfigs) != 1 {
+        return nil, errors.New("Exactly one route is expected")
+    }
+
+    return jongleurConfigs[0], nil
+}
+
+// All the routes share one etcd client
+func (config *Config) ToJongleurConfigs() ([]*jongleur.Config, error) {
     if err := utils.Check(config); err != nil {
         return nil, err
     }
 
-    if strings.Contains(config.Items, "/") {
-        return nil, errors.New("Invalid symbol in items: '/'")
+    routes, err := config.routes()
+    if err != nil {
+        return nil, err
+    }
+
+    if config.RemotePort != -1 && config.Options.Transparent {
+        return nil, utils.NewUsageError("\"remote-port\" and \"transparent\" options can not be used together")
     }
 
-    etcdKey := etcd_utils.EtcdItemsKey(config.Items)
-    remotePortStr := config.getRemotePortStr()
+    etcdClient, err := etcd_utils.NewEtcdClient(config.Period, []string{config.Etcd})
+    if err != nil {
+        return nil, err
+    }
+
+    keys := etcd.NewKeysAPI(etcdClient)
+
+    jongleurConfigs := make([]*jongleur.Config, 0, len(routes))
+
+    for i, route := range routes {
+        options := *config.Options
+        options.SNIRoutes = nil
 
-    itemsLoader, err := etcd_utils.NewEtcdItemsLoader(config.Period, []string{config.Etcd}, func (etcdClient etcd.Client) ([]string, error) {
-        keys := etcd.NewKeysAPI(etcdClient)
+        if i == 0 && config.Listen.Value != "" {
+            if options.SNIRoutes, err = config.sniRoutes(keys); err != nil {
+                return nil, err
+            }
+        }
+
+        jongleurConfigs = append(jongleurConfigs, &jongleur.Config{
+            Verbose: config.Verbose,
+            Listen: route.listen,
+            Period: config.Period,
+            ItemsLoader: config.itemsLoader(keys, route.items),
+            RequestPatcher: jongleur.IDENTICAL_PATCHER,
+            ResponsePatcher: jongleur.IDENTICAL_PATCHER,
+            Options: &options,
+        })
+    }
+
+    return jongleurConfigs, nil
+}
+
+type route struct {
+    listen string
+    items  string
+}
+
+// The route of "listen" and "items" options goes first
+func (config *Config) routes() ([]route, error) {
+    var routes []route
+
+    if config.Items.Value != "" || config.Listen.Value != "" {
+        if config.Items.Value == "" || config.Listen.Value == "" {
+            return nil, utils.NewUsageError("\"items\" and \"listen\" options must be specified together")
+        }
+        routes = append(routes, route{config.Listen.Value, config.Items.Value})
+    } else if len(config.SNIRoutes.Values) != 0 {
+        return nil, utils.NewUsageError("SNI routes require \"items\" and \"listen\" options")
+    }
+
+    values := config.Routes.Values
 
+    if config.RoutesFile.Value != "" {
+        fileValues, err := readRoutesFile(config.RoutesFile.Value)
+        if err != nil {
+            return nil, err
+        }
+        values = append(values, fileValues...)
+    }
+
+    for _, value := range values {
+        eqPos := strings.LastIndex(value, "=")
+        if eqPos == -1 {
+            return nil, fmt.Errorf("Invalid route \"%s\": \"<listen>=<items>\" expected", value)
+        }
+        routes = append(routes, route{value[:eqPos], value[eqPos + 1:]})
+    }
+
+    if len(routes) == 0 {
+        return nil, utils.NewUsageError("\"items\" and \"listen\" options are not specified")
+    }
+
+    listens := make(map[string]bool)
+
+    for _, route := range routes {
+        if err := checkItems(route.items); err != nil {
+            return nil, err
+        }
+
+        if listens[route.listen] {
+            return nil, fmt.Errorf("Duplicate listen address: \"%s\"", route.listen)
+        }
+
+        listens[route.listen] = true
+    }
+
+    return routes, nil
+}
+
+// Empty lines and lines starting with "#" are ignored
+func readRoutesFile(file string) ([]string, error) {
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+
+    var values []string
+
+    for _, line := range strings.Split(string(data), "\n") {
+        if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+            values = append(values, line)
+        }
+    }
+
+    return values, nil
+}
+
+func (config *Config) sniRoutes(keys etcd.KeysAPI) ([]jongleur.SNIRoute, error) {
+    var sniRoutes []jongleur.SNIRoute
+
+    for _, value := range config.SNIRoutes.Values {
+        eqPos := strings.LastIndex(value, "=")
+        if eqPos == -1 {
+            return nil, fmt.Errorf("Invalid SNI route \"%s\": \"<server name>=<items>\" expected", value)
+        }
+
+        serverName, items := value[:eqPos], value[eqPos + 1:]
+
+        if err := checkItems(items); err != nil {
+            return nil, err
+        }
+
+        sniRoutes = append(sniRoutes, jongleur.SNIRoute{
+            ServerName: serverName,
+            ItemsLoader: config.itemsLoader(keys, items),
+        })
+    }
+
+    return sniRoutes, nil
+}
+
+func checkItems(items string) error {
+    if items == "" {
+        return errors.New("Items must not be empty")
+    }
+
+    if strings.Contains(items, "/") {
+        return errors.New("Invalid symbol in items: '/'")
+    }
+
+    return nil
+}
+
+func (config *Config) itemsLoader(keys etcd.KeysAPI, items string) jongleur.ItemsLoader {
+    etcdKey := etcd_utils.EtcdItemsKey(items)
+    remotePortStr := config.getRemotePortStr()
+    transparent := config.Options.Transparent
+
+    return func() ([]cycle.Item, error) {
         response, err := keys.Get(context.Background(), etcdKey, nil)
         if err != nil {
             return nil, err
@@ -44,35 +229,33 @@ func (config *Config) ToJongleurConfig() (*jongleur.Config, error) {
             return nil, nil
         }
 
-        newItems := make([]string, 0)
+        newItems := make([]cycle.Item, 0)
 
         if response.Node.Nodes != nil {
             for _, node := range response.Node.Nodes {
                 if !node.Dir {
-                    item := simpleKey(node.Key)
+                    host := etcd_utils.UnescapeItemHost(simpleKey(node.Key))
 
                     if remotePortStr != "" {
-                        item = strings.Replace(item, "*", remotePortStr, -1)
+                        host = replaceAnyPort(host, remotePortStr)
                     }
 
-                    if !strings.Contains(item, "*") {
-                        newItems = append(newItems, item)
+                    if transparent || !strings.Contains(host, "*") {
+                        value := etcd_utils.ParseItemValue(node.Value)
+                        newItems = append(newItems, cycle.Item{
+                            Host: host,
+                            Weight: value.Weight,
+                            Zone: value.Zone,
+                            Priority: value.Priority,
+                            ServerName: value.ServerName,
+                        })
                     }
                 }
             }
         }
 
         return newItems, nil
-    })
-
-    return &jongleur.Config{
-        Verbose: config.Verbose,
-        Listen: config.Listen,
-        Period: config.Period,
-        ItemsLoader: itemsLoader,
-        RequestPatcher: jongleur.IDENTICAL_PATCHER,
-        ResponsePatcher: jongleur.IDENTICAL_PATCHER,
-    }, err
+    }
 }
 
 func (config *Config) getRemotePortStr() string {
@@ -83,6 +266,15 @@ func (config *Config) getRemotePortStr() string {
     }
 }
 
+// Works for "<ipv4>:*" and "[<ipv6>]:*" hosts
+func replaceAnyPort(host string, port string) string {
+    hostname, hostPort, err := net.SplitHostPort(host)
+    if err != nil || hostPort != "*" {
+        return host
+    }
+    return net.JoinHostPort(hostname, port)
+}
+
 func simpleKey(key string) string {
     pos := strings.LastIndex(key, "/")
     if pos == -1 {
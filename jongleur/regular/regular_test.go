@@ -0,0 +1,38 @@
+package regular
+
+import (
+    "github.com/maxmanuylov/jongleur/utils/etcd"
+    "testing"
+)
+
+func TestReplaceAnyPort(t *testing.T) {
+    tests := []struct {
+        host     string
+        expected string
+    }{
+        {"[2001:db8::1]:*", "[2001:db8::1]:8080"},
+        {"1.2.3.4:*", "1.2.3.4:8080"},
+        {"[::1]:80", "[::1]:80"},
+        {"1.2.3.4:80", "1.2.3.4:80"},
+        {"unix@/x", "unix@/x"},
+        {"unix@/run/*", "unix@/run/*"},
+    }
+
+    for _, test := range tests {
+        if host := replaceAnyPort(test.host, "8080"); host != test.expected {
+            t.Errorf("%s: expected %q, got %q", test.host, test.expected, host)
+        }
+    }
+}
+
+func TestItemHostFromKey(t *testing.T) {
+    hosts := []string{"1.2.3.4:80", "[2001:db8::1]:80", "[2001:db8::1]:*", "[fe80::1%eth0]:80", "unix@/run/svc.sock"}
+
+    for _, host := range hosts {
+        key := "/jongleur/items/svc/" + etcd_utils.EscapeItemHost(host)
+
+        if parsed := etcd_utils.UnescapeItemHost(simpleKey(key)); parsed != host {
+            t.Errorf("%s: key %q is parsed as %q", host, key, parsed)
+        }
+    }
+}
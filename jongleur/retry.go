@@ -0,0 +1,69 @@
+package jongleur
+
+import (
+    "errors"
+    "time"
+)
+
+const maxBackoffShift = 10
+
+type connectPolicy struct {
+    attempts int
+    timeout  time.Duration // Per attempt
+    deadline time.Duration // For all the attempts together; zero means no deadline
+    backoff  time.Duration // Delay before the first retry; it doubles for every next retry
+}
+
+func (options *Options) connectPolicy() (*connectPolicy, error) {
+    if options.ConnectAttempts <= 0 {
+        return nil, errors.New("Number of connect attempts must be positive")
+    }
+
+    if options.ConnectTimeout <= 0 {
+        return nil, errors.New("Connect timeout must be positive")
+    }
+
+    if options.ConnectDeadline < 0 || options.RetryBackoff < 0 {
+        return nil, errors.New("Connect deadline and retry backoff must not be negative")
+    }
+
+    return &connectPolicy{
+        attempts: options.ConnectAttempts,
+        timeout: time.Duration(options.ConnectTimeout) * time.Millisecond,
+        deadline: time.Duration(options.ConnectDeadline) * time.Millisecond,
+        backoff: time.Duration(options.RetryBackoff) * time.Millisecond,
+    }, nil
+}
+
+// Returns zero time if there is no deadline
+func (policy *connectPolicy) deadlineFrom(start time.Time) time.Time {
+    if policy.deadline == 0 {
+        return time.Time{}
+    }
+    return start.Add(policy.deadline)
+}
+
+// Returns the delay before the given attempt (starting from zero) and the timeout of the attempt;
+// non-positive timeout means the deadline is exceeded
+func (policy *connectPolicy) schedule(attempt int, deadline time.Time) (time.Duration, time.Duration) {
+    var delay time.Duration
+
+    if attempt > 0 && policy.backoff > 0 {
+        shift := uint(attempt - 1)
+        if shift > maxBackoffShift {
+            shift = maxBackoffShift
+        }
+        delay = policy.backoff << shift
+    }
+
+    if deadline.IsZero() {
+        return delay, policy.timeout
+    }
+
+    left := deadline.Sub(time.Now()) - delay
+    if left < policy.timeout {
+        return delay, left
+    }
+
+    return delay, policy.timeout
+}
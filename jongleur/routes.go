@@ -0,0 +1,137 @@
+package jongleur
+
+import (
+    "crypto/tls"
+    "fmt"
+    "github.com/maxmanuylov/jongleur/utils/cycle"
+    "log"
+    "strings"
+    "time"
+)
+
+// Client connections having TLS server name matching the route one are routed to the route items
+type SNIRoute struct {
+    ServerName  string // Exact name or "*.<domain>" wildcard matching any subdomain
+    ItemsLoader ItemsLoader
+}
+
+// Items with their own picker; the default route gets the connections not matching any other route
+type route struct {
+    serverName string // Empty for the default route
+    loadItems  ItemsLoader
+    picker     *cycle.Picker
+}
+
+func (options *Options) pickerConfig() cycle.PickerConfig {
+    return cycle.PickerConfig{
+        Strategy: options.Balance,
+        EjectFailures: options.EjectFailures,
+        EjectTime: time.Duration(options.EjectTime) * time.Second,
+        MaxEjectPercent: options.MaxEjectPercent,
+        LocalZone: options.Zone,
+        ZoneMinHealthy: options.ZoneMinHealthy,
+        SlowStart: time.Duration(options.SlowStart) * time.Second,
+        FailurePenalty: time.Duration(options.ConnectTimeout) * time.Millisecond,
+    }
+}
+
+func (config *Config) routes(logger *log.Logger) ([]*route, error) {
+    loaders := []SNIRoute{{ItemsLoader: config.ItemsLoader}}
+    serverNames := make(map[string]bool)
+
+    for _, sniRoute := range config.Options.SNIRoutes {
+        serverName := normalizeServerName(sniRoute.ServerName)
+
+        if serverName == "" || strings.Contains(serverName[1:], "*") || (serverName[0] == '*' && !strings.HasPrefix(serverName, "*.")) {
+            return nil, fmt.Errorf("Invalid route server name: \"%s\"", sniRoute.ServerName)
+        }
+
+        if serverNames[serverName] {
+            return nil, fmt.Errorf("Duplicate route server name: \"%s\"", sniRoute.ServerName)
+        }
+
+        serverNames[serverName] = true
+        loaders = append(loaders, SNIRoute{serverName, sniRoute.ItemsLoader})
+    }
+
+    routes := make([]*route, len(loaders))
+
+    for i, loader := range loaders {
+        picker, err := cycle.NewPicker(config.Options.pickerConfig(), logger)
+        if err != nil {
+            return nil, err
+        }
+
+        routes[i] = &route{loader.ServerName, loader.ItemsLoader, picker}
+    }
+
+    return routes, nil
+}
+
+// Picks the route by the TLS server name; the ClientHello is peeked if TLS is not terminated by the proxy,
+// so the returned connection must be used instead of the original one to get the peeked bytes
+func selectRoute(clientConnection WriteCloseableConn, data *runtimeData, n int64) (*route, WriteCloseableConn, error) {
+    if len(data.routes) == 1 {
+        return data.routes[0], clientConnection, nil
+    }
+
+    var serverName string
+
+    if tlsConnection, ok := clientConnection.(*tls.Conn); ok {
+        serverName = tlsConnection.ConnectionState().ServerName
+    } else {
+        clientConnection.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+
+        peekedConnection, peekedServerName, err := peekServerName(clientConnection)
+        if err != nil {
+            return nil, nil, err
+        }
+
+        clientConnection.SetReadDeadline(time.Time{})
+
+        clientConnection, serverName = peekedConnection, peekedServerName
+    }
+
+    route := matchRoute(data.routes, normalizeServerName(serverName))
+
+    if data.verbose {
+        if route.serverName == "" {
+            data.logger.Printf("[%d] Server name \"%s\" is routed to the default items\n", n, serverName)
+        } else {
+            data.logger.Printf("[%d] Server name \"%s\" is routed to \"%s\"\n", n, serverName, route.serverName)
+        }
+    }
+
+    return route, clientConnection, nil
+}
+
+// Exact names take precedence over wildcards; longer wildcards take precedence over shorter ones
+func matchRoute(routes []*route, serverName string) *route {
+    if serverName == "" {
+        return routes[0]
+    }
+
+    var matched *route
+
+    for _, route := range routes[1:] {
+        if route.serverName == serverName {
+            return route
+        }
+
+        if strings.HasPrefix(route.serverName, "*.") && strings.HasSuffix(serverName, route.serverName[1:]) {
+            if matched == nil || len(route.serverName) > len(matched.serverName) {
+                matched = route
+            }
+        }
+    }
+
+    if matched == nil {
+        return routes[0]
+    }
+
+    return matched
+}
+
+func normalizeServerName(serverName string) string {
+    return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(serverName), "."))
+}
@@ -0,0 +1,153 @@
+package jongleur
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io"
+    "time"
+)
+
+const (
+    clientHelloTimeout   = 5 * time.Second
+    clientHelloMaxLength = 64 * 1024
+
+    tlsRecordHandshake      = 0x16
+    tlsHandshakeClientHello = 0x01
+    tlsExtensionServerName  = 0x0000
+    tlsServerNameHost       = 0x00
+)
+
+// Client connection replaying the bytes read to peek the ClientHello
+type peekedConn struct {
+    WriteCloseableConn
+    reader io.Reader
+}
+
+func (conn *peekedConn) Read(b []byte) (int, error) {
+    return conn.reader.Read(b)
+}
+
+// Reads the TLS ClientHello and extracts the server name from it; the server name is empty if the client
+// does not send it or does not speak TLS at all. Only the read errors are returned.
+func peekServerName(clientConnection WriteCloseableConn) (WriteCloseableConn, string, error) {
+    peeked := &bytes.Buffer{}
+    message, err := readHandshakeMessage(io.TeeReader(clientConnection, peeked))
+
+    peekedConnection := &peekedConn{clientConnection, io.MultiReader(peeked, clientConnection)}
+
+    if err != nil {
+        if err == errNotHandshake {
+            return peekedConnection, "", nil
+        }
+        return nil, "", err
+    }
+
+    return peekedConnection, parseServerName(message), nil
+}
+
+var errNotHandshake = errors.New("Not a TLS handshake")
+
+// Reads the first handshake message which can span several TLS records
+func readHandshakeMessage(from io.Reader) ([]byte, error) {
+    var message []byte
+    header := make([]byte, 5)
+
+    for len(message) < 4 || len(message) < 4 + int(uint32(message[1]) << 16 | uint32(message[2]) << 8 | uint32(message[3])) {
+        if len(message) > clientHelloMaxLength {
+            return nil, errNotHandshake
+        }
+
+        if _, err := io.ReadFull(from, header); err != nil {
+            return nil, err
+        }
+
+        if header[0] != tlsRecordHandshake {
+            return nil, errNotHandshake
+        }
+
+        fragment := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+        if _, err := io.ReadFull(from, fragment); err != nil {
+            return nil, err
+        }
+
+        message = append(message, fragment...)
+    }
+
+    if message[0] != tlsHandshakeClientHello {
+        return nil, errNotHandshake
+    }
+
+    return message, nil
+}
+
+// Returns empty string if there is no server name extension or the message is malformed
+func parseServerName(message []byte) string {
+    hello := &tlsReader{data: message[4:]}
+
+    hello.skip(2 + 32) // Version and random
+    hello.skip(int(hello.uint8())) // Session ID
+    hello.skip(int(hello.uint16())) // Cipher suites
+    hello.skip(int(hello.uint8())) // Compression methods
+
+    extensions := &tlsReader{data: hello.bytes(int(hello.uint16()))}
+
+    for !extensions.failed && len(extensions.data) != 0 {
+        extensionType := extensions.uint16()
+        extension := &tlsReader{data: extensions.bytes(int(extensions.uint16()))}
+
+        if extensionType != tlsExtensionServerName {
+            continue
+        }
+
+        names := &tlsReader{data: extension.bytes(int(extension.uint16()))}
+
+        for !names.failed && len(names.data) != 0 {
+            nameType := names.uint8()
+            name := names.bytes(int(names.uint16()))
+
+            if nameType == tlsServerNameHost && !names.failed {
+                return string(name)
+            }
+        }
+    }
+
+    return ""
+}
+
+// Bounds-checked reader; reads return zero values after the data is exhausted
+type tlsReader struct {
+    data   []byte
+    failed bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+    if r.failed || n > len(r.data) {
+        r.failed = true
+        r.data = nil
+        return nil
+    }
+
+    result := r.data[:n]
+    r.data = r.data[n:]
+
+    return result
+}
+
+func (r *tlsReader) skip(n int) {
+    r.bytes(n)
+}
+
+func (r *tlsReader) uint8() uint8 {
+    if b := r.bytes(1); b != nil {
+        return b[0]
+    }
+    return 0
+}
+
+func (r *tlsReader) uint16() uint16 {
+    if b := r.bytes(2); b != nil {
+        return binary.BigEndian.Uint16(b)
+    }
+    return 0
+}
@@ -0,0 +1,281 @@
+package jongleur
+
+import (
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "io"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "testing"
+    "time"
+)
+
+// net.Pipe() connections do not support half-close
+type pipeConn struct {
+    net.Conn
+}
+
+func (conn *pipeConn) CloseWrite() error {
+    return nil
+}
+
+// Runs the TLS client handshake and returns the server side of the connection; the client handshake
+// is abandoned when the server side is closed
+func clientHelloConnection(serverName string) *pipeConn {
+    clientEnd, serverEnd := net.Pipe()
+
+    go func() {
+        defer clientEnd.Close()
+        tls.Client(clientEnd, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+    }()
+
+    return &pipeConn{serverEnd}
+}
+
+func captureClientHello(t *testing.T, serverName string) []byte {
+    connection := clientHelloConnection(serverName)
+    defer connection.Close()
+
+    message, err := readHandshakeMessage(connection)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return message
+}
+
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{CommonName: "svc.internal"},
+        DNSNames: []string{"svc.internal"},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestPeekServerName(t *testing.T) {
+    for _, serverName := range []string{"svc.internal", ""} {
+        connection := clientHelloConnection(serverName)
+
+        peekedConnection, peekedServerName, err := peekServerName(connection)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if peekedServerName != serverName {
+            t.Errorf("Expected server name %q, got %q", serverName, peekedServerName)
+        }
+
+        peekedConnection.Close()
+    }
+}
+
+func TestPeekedClientHelloIsReplayed(t *testing.T) {
+    certificate := selfSignedCertificate(t)
+    clientEnd, serverEnd := net.Pipe()
+
+    clientResult := make(chan error, 1)
+    go func() {
+        defer clientEnd.Close()
+
+        client := tls.Client(clientEnd, &tls.Config{ServerName: "svc.internal", InsecureSkipVerify: true})
+        if err := client.Handshake(); err != nil {
+            clientResult <- err
+            return
+        }
+
+        _, err := client.Write([]byte("hello"))
+        clientResult <- err
+    }()
+
+    peekedConnection, serverName, err := peekServerName(&pipeConn{serverEnd})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if serverName != "svc.internal" {
+        t.Errorf("Unexpected server name: %q", serverName)
+    }
+
+    server := tls.Server(peekedConnection, &tls.Config{Certificates: []tls.Certificate{certificate}})
+    defer server.Close()
+
+    if err := server.Handshake(); err != nil {
+        t.Fatalf("Handshake over the peeked connection failed: %v", err)
+    }
+
+    data := make([]byte, 5)
+    if _, err := io.ReadFull(server, data); err != nil || string(data) != "hello" {
+        t.Errorf("Unexpected data after the handshake: %q (%v)", data, err)
+    }
+
+    if err := <-clientResult; err != nil {
+        t.Errorf("Client failed: %v", err)
+    }
+}
+
+func TestNonTLSInputIsReplayed(t *testing.T) {
+    inputs := []string{
+        "GET / HTTP/1.1\r\nHost: svc.internal\r\n\r\n",
+        "\x16\x03\x01\x00\x04\x02\x00\x00\x00 not a ClientHello",
+        "SSH-2.0-OpenSSH_7.4\r\n",
+    }
+
+    for _, input := range inputs {
+        clientEnd, serverEnd := net.Pipe()
+
+        go func(input string) {
+            defer clientEnd.Close()
+            clientEnd.Write([]byte(input))
+        }(input)
+
+        peekedConnection, serverName, err := peekServerName(&pipeConn{serverEnd})
+        if err != nil {
+            t.Fatalf("%q: %v", input, err)
+        }
+
+        if serverName != "" {
+            t.Errorf("%q: unexpected server name %q", input, serverName)
+        }
+
+        replayed, err := ioutil.ReadAll(peekedConnection)
+        if err != nil || string(replayed) != input {
+            t.Errorf("Expected %q to be replayed, got %q (%v)", input, replayed, err)
+        }
+
+        peekedConnection.Close()
+    }
+}
+
+func TestShortInputFails(t *testing.T) {
+    clientEnd, serverEnd := net.Pipe()
+
+    go func() {
+        defer clientEnd.Close()
+        clientEnd.Write([]byte{tlsRecordHandshake, 3, 1})
+    }()
+
+    if _, _, err := peekServerName(&pipeConn{serverEnd}); err == nil {
+        t.Error("Expected an error for the truncated record header")
+    }
+}
+
+func TestClientHelloSplitAcrossRecords(t *testing.T) {
+    message := captureClientHello(t, "svc.internal")
+
+    for _, fragmentSize := range []int{1, 3, 50, len(message) - 1} {
+        records := &bytes.Buffer{}
+
+        for rest := message; len(rest) != 0; {
+            size := fragmentSize
+            if size > len(rest) {
+                size = len(rest)
+            }
+
+            records.Write([]byte{tlsRecordHandshake, 3, 1, byte(size >> 8), byte(size)})
+            records.Write(rest[:size])
+
+            rest = rest[size:]
+        }
+
+        reassembled, err := readHandshakeMessage(records)
+        if err != nil {
+            t.Fatalf("Fragment size %d: %v", fragmentSize, err)
+        }
+
+        if !bytes.Equal(reassembled, message) {
+            t.Errorf("Fragment size %d: message is not reassembled", fragmentSize)
+        }
+
+        if serverName := parseServerName(reassembled); serverName != "svc.internal" {
+            t.Errorf("Fragment size %d: unexpected server name %q", fragmentSize, serverName)
+        }
+    }
+}
+
+func TestMalformedClientHello(t *testing.T) {
+    message := captureClientHello(t, "svc.internal")
+
+    for length := 4; length < len(message); length++ {
+        if serverName := parseServerName(message[:length]); serverName != "" {
+            t.Fatalf("Server name %q is parsed from the message truncated to %d bytes", serverName, length)
+        }
+    }
+
+    nameOffset := bytes.Index(message, []byte("svc.internal"))
+    if nameOffset < 9 {
+        t.Fatal("Server name is not found in the ClientHello")
+    }
+
+    // Server name extension layout before the name: type(2) length(2) list length(2) name type(1) name length(2)
+    lengthFields := map[string]int{
+        "extension length": nameOffset - 7,
+        "server name list length": nameOffset - 5,
+        "server name length": nameOffset - 2,
+    }
+
+    for field, offset := range lengthFields {
+        malformed := append([]byte{}, message...)
+        malformed[offset], malformed[offset + 1] = 0xFF, 0xFF
+
+        if serverName := parseServerName(malformed); serverName == "svc.internal" {
+            t.Errorf("Server name is parsed with broken %s", field)
+        }
+    }
+
+    // Every byte corrupted in turn must not break the parser
+    for i := 4; i < len(message); i++ {
+        corrupted := append([]byte{}, message...)
+        corrupted[i] ^= 0xFF
+        parseServerName(corrupted)
+    }
+}
+
+func TestMatchRoute(t *testing.T) {
+    routes := []*route{{serverName: ""}, {serverName: "*.example.com"}, {serverName: "x.a.example.com"}, {serverName: "*.a.example.com"}}
+
+    tests := []struct {
+        serverName string
+        expected   string
+    }{
+        {"x.a.example.com", "x.a.example.com"}, // Exact match beats any wildcard
+        {"y.a.example.com", "*.a.example.com"}, // Longer wildcard beats shorter one
+        {"z.y.a.example.com", "*.a.example.com"},
+        {"b.example.com", "*.example.com"},
+        {"a.example.com", "*.example.com"},
+        {"example.com", ""}, // Wildcard does not match the domain itself
+        {"notexample.com", ""},
+        {"other.org", ""},
+        {"", ""},
+    }
+
+    for _, test := range tests {
+        if matched := matchRoute(routes, test.serverName); matched.serverName != test.expected {
+            t.Errorf("%q: expected route %q, got %q", test.serverName, test.expected, matched.serverName)
+        }
+    }
+}
+
+func TestNormalizeServerName(t *testing.T) {
+    if serverName := normalizeServerName(" X.Example.COM. "); serverName != "x.example.com" {
+        t.Errorf("Unexpected normalized server name: %q", serverName)
+    }
+}
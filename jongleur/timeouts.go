@@ -0,0 +1,100 @@
+package jongleur
+
+import (
+    "io"
+    "sync/atomic"
+    "time"
+)
+
+// Closes both sides of a link when it is idle for too long or lives longer than allowed
+type linkWatchdog struct {
+    lastActivity int64 // UnixNano; accessed atomically
+    stopped      int32 // Accessed atomically
+    connections  []io.Closer
+    idleTimer    *time.Timer
+    lifeTimer    *time.Timer
+    data         *runtimeData
+    n            int64
+}
+
+// Returns nil if neither idle timeout nor maximum lifetime is configured
+func watchLink(clientConnection, serviceConnection io.Closer, data *runtimeData, n int64) *linkWatchdog {
+    if data.idleTimeout <= 0 && data.maxConnLifetime <= 0 {
+        return nil
+    }
+
+    watchdog := &linkWatchdog{
+        lastActivity: time.Now().UnixNano(),
+        connections: []io.Closer{clientConnection, serviceConnection},
+        data: data,
+        n: n,
+    }
+
+    if data.idleTimeout > 0 {
+        watchdog.idleTimer = time.AfterFunc(data.idleTimeout, watchdog.checkIdle)
+    }
+
+    if data.maxConnLifetime > 0 {
+        watchdog.lifeTimer = time.AfterFunc(data.maxConnLifetime, func() {
+            watchdog.close("Connection lifetime limit is reached")
+        })
+    }
+
+    return watchdog
+}
+
+func (watchdog *linkWatchdog) checkIdle() {
+    if atomic.LoadInt32(&watchdog.stopped) != 0 {
+        return
+    }
+
+    idle := time.Since(time.Unix(0, atomic.LoadInt64(&watchdog.lastActivity)))
+
+    if idle < watchdog.data.idleTimeout {
+        watchdog.idleTimer.Reset(watchdog.data.idleTimeout - idle)
+        return
+    }
+
+    watchdog.close("Connection is idle for too long")
+}
+
+func (watchdog *linkWatchdog) close(reason string) {
+    if watchdog.data.verbose {
+        watchdog.data.logger.Printf("[%d] %s, closing\n", watchdog.n, reason)
+    }
+
+    for _, connection := range watchdog.connections {
+        connection.Close()
+    }
+}
+
+func (watchdog *linkWatchdog) stop() {
+    atomic.StoreInt32(&watchdog.stopped, 1)
+
+    if watchdog.idleTimer != nil {
+        watchdog.idleTimer.Stop()
+    }
+    if watchdog.lifeTimer != nil {
+        watchdog.lifeTimer.Stop()
+    }
+}
+
+func (watchdog *linkWatchdog) reader(from io.Reader) io.Reader {
+    if watchdog.idleTimer == nil {
+        return from
+    }
+    return &activityReader{from, watchdog}
+}
+
+type activityReader struct {
+    from     io.Reader
+    watchdog *linkWatchdog
+}
+
+func (reader *activityReader) Read(p []byte) (int, error) {
+    n, err := reader.from.Read(p)
+    if n > 0 {
+        atomic.StoreInt64(&reader.watchdog.lastActivity, time.Now().UnixNano())
+    }
+    return n, err
+}
@@ -0,0 +1,200 @@
+package jongleur
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net"
+    "os"
+    "sync/atomic"
+    "time"
+)
+
+const tlsReloadPeriod = 5 * time.Second
+
+// TLS termination settings; certificate files are periodically checked for changes and reloaded, handshakes take
+// the current configuration without locking
+type tlsTermination struct {
+    config           atomic.Value // *tls.Config
+
+    certFile         string
+    keyFile          string
+    clientCAFile     string
+    handshakeTimeout time.Duration
+    logger           *log.Logger
+
+    versions         []fileVersion // Nil if the files could not be checked; accessed by the watching goroutine only
+}
+
+type fileVersion struct {
+    modTime time.Time
+    size    int64
+}
+
+func (options *Options) tlsTermination(logger *log.Logger) (*tlsTermination, error) {
+    if options.TLSCert == "" && options.TLSKey == "" {
+        if options.TLSClientCA != "" {
+            return nil, errors.New("Client CA requires TLS certificate and key")
+        }
+        return nil, nil
+    }
+
+    if options.TLSCert == "" || options.TLSKey == "" {
+        return nil, errors.New("Both TLS certificate and key must be specified")
+    }
+
+    if options.TLSHandshakeTimeout <= 0 {
+        return nil, errors.New("TLS handshake timeout must be positive")
+    }
+
+    termination := &tlsTermination{
+        certFile: options.TLSCert,
+        keyFile: options.TLSKey,
+        clientCAFile: options.TLSClientCA,
+        handshakeTimeout: time.Duration(options.TLSHandshakeTimeout) * time.Second,
+        logger: logger,
+    }
+
+    versions, err := fileVersions(termination.files())
+    if err != nil {
+        return nil, err
+    }
+
+    config, err := termination.load()
+    if err != nil {
+        return nil, err
+    }
+
+    termination.config.Store(config)
+    termination.versions = versions
+
+    return termination, nil
+}
+
+func (termination *tlsTermination) files() []string {
+    files := []string{termination.certFile, termination.keyFile}
+    if termination.clientCAFile != "" {
+        files = append(files, termination.clientCAFile)
+    }
+    return files
+}
+
+func (termination *tlsTermination) watch(stop <-chan struct{}) {
+    reloadTicker := time.NewTicker(tlsReloadPeriod)
+    defer reloadTicker.Stop()
+
+    for {
+        select {
+        case <-reloadTicker.C:
+            termination.reload()
+        case <-stop:
+            return
+        }
+    }
+}
+
+// Reloads the configuration if any of the files is changed; the previous configuration is kept if the new one is broken
+func (termination *tlsTermination) reload() {
+    versions, err := fileVersions(termination.files())
+    if sameVersions(versions, termination.versions) {
+        return // Files still missing after the failure are not reported again
+    }
+
+    termination.versions = versions // Not to retry until the files are changed again
+
+    if err == nil {
+        var config *tls.Config
+        if config, err = termination.load(); err == nil {
+            termination.config.Store(config)
+            termination.logger.Println("TLS certificates are reloaded")
+            return
+        }
+    }
+
+    termination.logger.Printf("Failed to reload TLS certificates, the previous ones are used: %s\n", err.Error())
+}
+
+func (termination *tlsTermination) load() (*tls.Config, error) {
+    certificate, err := tls.LoadX509KeyPair(termination.certFile, termination.keyFile)
+    if err != nil {
+        return nil, err
+    }
+
+    config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+
+    if termination.clientCAFile != "" {
+        pool, err := loadCertPool(termination.clientCAFile)
+        if err != nil {
+            return nil, err
+        }
+
+        config.ClientCAs = pool
+        config.ClientAuth = tls.RequireAndVerifyClientCert
+    }
+
+    return config, nil
+}
+
+func (termination *tlsTermination) handshake(clientConnection net.Conn) (*tls.Conn, error) {
+    tlsConnection := tls.Server(clientConnection, &tls.Config{
+        GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+            return termination.config.Load().(*tls.Config), nil
+        },
+    })
+
+    tlsConnection.SetDeadline(time.Now().Add(termination.handshakeTimeout))
+
+    if err := tlsConnection.Handshake(); err != nil {
+        return nil, err
+    }
+
+    tlsConnection.SetDeadline(time.Time{})
+
+    return tlsConnection, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(data) {
+        return nil, fmt.Errorf("No certificates found in \"%s\"", file)
+    }
+
+    return pool, nil
+}
+
+func fileVersions(files []string) ([]fileVersion, error) {
+    versions := make([]fileVersion, len(files))
+
+    for i, file := range files {
+        info, err := os.Stat(file)
+        if err != nil {
+            return nil, err
+        }
+
+        versions[i] = fileVersion{info.ModTime(), info.Size()}
+    }
+
+    return versions, nil
+}
+
+func sameVersions(versions1 []fileVersion, versions2 []fileVersion) bool {
+    if len(versions1) != len(versions2) {
+        return false
+    }
+
+    for i := range versions1 {
+        if !versions1[i].modTime.Equal(versions2[i].modTime) || versions1[i].size != versions2[i].size {
+            return false
+        }
+    }
+
+    return true
+}
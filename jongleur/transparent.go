@@ -0,0 +1,99 @@
+package jongleur
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// Endpoints registered with "*" port get the connections on their original destination port
+const anyPort = "*"
+
+// Client connection redirected to the proxy; its local address is the original destination
+type transparentConn struct {
+    WriteCloseableConn
+    destination net.Addr
+}
+
+func (conn *transparentConn) LocalAddr() net.Addr {
+    return conn.destination
+}
+
+// Only TCP connections have the original destination to take "*" ports from
+func checkTransparent(transparent bool, network string) error {
+    if !transparent {
+        return nil
+    }
+
+    if !transparentSupported {
+        return errors.New("Transparent mode is supported on Linux only")
+    }
+
+    if !strings.HasPrefix(network, "tcp") {
+        return fmt.Errorf("Transparent mode requires a TCP listener, \"%s\" is specified", network)
+    }
+
+    return nil
+}
+
+// Makes the listener accept TPROXY connections; without the privileges for that only REDIRECT connections are accepted
+func transparentListenControl(logger *log.Logger) func(string, string, syscall.RawConn) error {
+    return func(network string, address string, rawConn syscall.RawConn) error {
+        if err := setTransparentOption(network, rawConn); err != nil {
+            logger.Printf("Listener on %s is not transparent, TPROXY connections will not be accepted: %v\n", address, err)
+        }
+        return nil
+    }
+}
+
+// Connections that are not redirected are rejected, since they would be proxied to the proxy itself
+func redirectedConnection(connection net.Conn, listenAddr net.Addr) (net.Conn, error) {
+    tcpConnection, ok := connection.(*net.TCPConn)
+    if !ok {
+        return connection, nil
+    }
+
+    localAddr, ok := connection.LocalAddr().(*net.TCPAddr)
+    if !ok {
+        return connection, nil
+    }
+
+    // Connections that are not NATed have the local address as the original destination if conntrack is loaded
+    destination, err := originalDestination(tcpConnection)
+    if err == nil && !(destination.IP.Equal(localAddr.IP) && destination.Port == localAddr.Port) {
+        return &transparentConn{tcpConnection, destination}, nil
+    }
+
+    // TPROXY keeps the original destination as the local address, while direct connections come to the listener port
+    if listenTCPAddr, ok := listenAddr.(*net.TCPAddr); ok && localAddr.Port == listenTCPAddr.Port {
+        if err != nil {
+            return nil, fmt.Errorf("Connection is not redirected: %v", err)
+        }
+        return nil, errors.New("Connection is not redirected")
+    }
+
+    return connection, nil
+}
+
+// Replaces "*" port of the endpoint host with the destination port of the client connection
+func resolveHost(host string, clientConnection net.Conn) (string, error) {
+    hostname, port, err := net.SplitHostPort(host)
+    if err != nil || port != anyPort {
+        return host, nil
+    }
+
+    destination, ok := clientConnection.LocalAddr().(*net.TCPAddr)
+    if !ok {
+        return "", fmt.Errorf("No destination port for \"%s\"", host)
+    }
+
+    return net.JoinHostPort(hostname, strconv.Itoa(destination.Port)), nil
+}
+
+func isAnyPortHost(host string) bool {
+    return strings.HasSuffix(host, ":" + anyPort)
+}
@@ -0,0 +1,86 @@
+// +build linux
+
+package jongleur
+
+import (
+    "net"
+    "strings"
+    "syscall"
+    "unsafe"
+)
+
+const transparentSupported = true
+
+const (
+    soOriginalDst   = 80 // SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST from netfilter headers
+    ipv6Transparent = 75 // IPV6_TRANSPARENT; missing in the syscall package
+)
+
+// Destination of the connection before it was redirected by iptables
+func originalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+    rawConn, err := conn.SyscallConn()
+    if err != nil {
+        return nil, err
+    }
+
+    ipv6 := false
+    if localAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok && localAddr.IP.To4() == nil {
+        ipv6 = true
+    }
+
+    var destination *net.TCPAddr
+    var sockErr error
+
+    if err := rawConn.Control(func(fd uintptr) {
+        destination, sockErr = getOriginalDestination(int(fd), ipv6)
+    }); err != nil {
+        return nil, err
+    }
+
+    return destination, sockErr
+}
+
+func getOriginalDestination(fd int, ipv6 bool) (*net.TCPAddr, error) {
+    if ipv6 {
+        info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, soOriginalDst)
+        if err != nil {
+            return nil, err
+        }
+
+        port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port)) // Network byte order
+
+        return &net.TCPAddr{
+            IP: net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+            Port: int(port[0]) << 8 | int(port[1]),
+        }, nil
+    }
+
+    // sockaddr_in fits into ipv6_mreq
+    mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, soOriginalDst)
+    if err != nil {
+        return nil, err
+    }
+
+    return &net.TCPAddr{
+        IP: net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+        Port: int(mreq.Multiaddr[2]) << 8 | int(mreq.Multiaddr[3]),
+    }, nil
+}
+
+// TPROXY delivers the connections to foreign addresses only to the sockets with this option; it requires CAP_NET_ADMIN.
+// The option of an IPv6 socket applies to the IPv4 connections it gets as well.
+func setTransparentOption(network string, rawConn syscall.RawConn) error {
+    var sockErr error
+
+    if err := rawConn.Control(func(fd uintptr) {
+        if strings.HasSuffix(network, "6") {
+            sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Transparent, 1)
+        } else {
+            sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TRANSPARENT, 1)
+        }
+    }); err != nil {
+        return err
+    }
+
+    return sockErr
+}
@@ -0,0 +1,19 @@
+// +build !linux
+
+package jongleur
+
+import (
+    "errors"
+    "net"
+    "syscall"
+)
+
+const transparentSupported = false
+
+func originalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+    return nil, errors.New("Original destination is available on Linux only")
+}
+
+func setTransparentOption(network string, rawConn syscall.RawConn) error {
+    return errors.New("Transparent sockets are available on Linux only")
+}
@@ -0,0 +1,124 @@
+package jongleur
+
+import (
+    "io/ioutil"
+    "log"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestDirectConnectionIsNotRedirected(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+
+    client, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    connection, err := listener.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer connection.Close()
+
+    if redirected, err := redirectedConnection(connection, listener.Addr()); err == nil {
+        t.Errorf("Direct connection must be rejected, got destination %v", redirected.LocalAddr())
+    }
+
+    // The socket must stay non-blocking after the original destination lookup, otherwise deadlines stop working
+    connection.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+    read := make(chan error, 1)
+    go func() {
+        _, err := connection.Read(make([]byte, 1))
+        read <- err
+    }()
+
+    select {
+    case err := <-read:
+        if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+            t.Errorf("Expected a timeout, got %v", err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Error("Read deadline is not applied")
+    }
+}
+
+func TestCheckTransparent(t *testing.T) {
+    tests := []struct {
+        transparent bool
+        network     string
+        valid       bool
+    }{
+        {false, "unix", true},
+        {false, "udp", true},
+        {true, "tcp", transparentSupported},
+        {true, "tcp6", transparentSupported},
+        {true, "unix", false},
+        {true, "udp", false},
+    }
+
+    for _, test := range tests {
+        if err := checkTransparent(test.transparent, test.network); (err == nil) != test.valid {
+            t.Errorf("Transparent %v on %s: expected valid %v, got %v", test.transparent, test.network, test.valid, err)
+        }
+    }
+}
+
+// The listener is created even without the privileges for the transparent option
+func TestTransparentListen(t *testing.T) {
+    if !transparentSupported {
+        t.Skip("Transparent mode is not supported")
+    }
+
+    options := DefaultOptions()
+    options.Transparent = true
+
+    for _, listen := range []string{"127.0.0.1:0", "tcp6@[::1]:0"} {
+        config := &Config{Listen: listen, Options: options}
+
+        listener, err := config.listen(log.New(ioutil.Discard, "", 0))
+        if err != nil {
+            if listen == "tcp6@[::1]:0" {
+                continue // No IPv6 in the environment
+            }
+            t.Fatal(err)
+        }
+
+        listener.Close()
+    }
+}
+
+func TestResolveHost(t *testing.T) {
+    tests := []struct {
+        host        string
+        destination net.Addr
+        expected    string // Empty if an error is expected
+    }{
+        {"10.0.0.1:80", &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 443}, "10.0.0.1:80"},
+        {"10.0.0.1:*", &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 443}, "10.0.0.1:443"},
+        {"[2001:db8::1]:*", &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}, "[2001:db8::1]:443"},
+        {"unix@/run/svc.sock", &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 443}, "unix@/run/svc.sock"},
+        {"10.0.0.1:*", &net.UnixAddr{Name: "/run/proxy.sock", Net: "unix"}, ""},
+    }
+
+    for _, test := range tests {
+        clientConnection := &transparentConn{destination: test.destination}
+
+        host, err := resolveHost(test.host, clientConnection)
+
+        if test.expected == "" {
+            if err == nil {
+                t.Errorf("%s: expected an error, got %q", test.host, host)
+            }
+        } else if err != nil || host != test.expected {
+            t.Errorf("%s: expected %q, got %q (%v)", test.host, test.expected, host, err)
+        }
+    }
+}
@@ -0,0 +1,238 @@
+package jongleur
+
+import (
+    "errors"
+    "github.com/maxmanuylov/jongleur/utils/cycle"
+    "net"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const maxDatagramSize = 64 * 1024
+
+// Datagrams of the same client address form a flow which is relayed to a single endpoint until it becomes idle
+type udpSession struct {
+    lastActive int64 // Unix nanoseconds; accessed atomically; kept first for 64-bit alignment
+
+    n          int64
+    client     net.Addr
+    endpoint   *cycle.Endpoint
+    service    *net.UDPConn
+}
+
+type udpSessions struct {
+    sessions map[string]*udpSession
+    lock     *sync.Mutex
+}
+
+func isUDP(network string) bool {
+    return strings.HasPrefix(network, "udp")
+}
+
+func (data *runtimeData) checkUDP() error {
+    switch {
+    case data.udpSessionTimeout <= 0:
+        return errors.New("UDP session timeout must be positive")
+    case len(data.routes) != 1:
+        return errors.New("SNI routes are not supported for UDP")
+    case data.tls != nil || data.backendTLS != nil:
+        return errors.New("TLS is not supported for UDP")
+    case data.proxyTrust != nil || data.sendProxy != "":
+        return errors.New("PROXY protocol is not supported for UDP")
+    case data.probe != nil:
+        return errors.New("Active health checks are not supported for UDP")
+    case data.transparent:
+        return errors.New("Transparent mode is not supported for UDP")
+    }
+    return nil
+}
+
+func runUDPProxy(listener net.PacketConn, data *runtimeData) {
+    sessions := &udpSessions{sessions: make(map[string]*udpSession), lock: &sync.Mutex{}}
+    buffer := make([]byte, maxDatagramSize)
+
+    var n int64 = 0
+    for {
+        size, clientAddr, err := listener.ReadFrom(buffer)
+        if err != nil {
+            select {
+            case <-data.stop:
+            default:
+                data.logger.Printf("[Server] %s\n", err.Error())
+            }
+            return
+        }
+
+        session := sessions.get(clientAddr)
+        if session == nil {
+            n++
+            if session = startUDPSession(listener, clientAddr, sessions, data, n); session == nil {
+                continue
+            }
+        }
+
+        atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+
+        if _, err := session.service.Write(buffer[:size]); err != nil && data.verbose {
+            data.logger.Printf("[%d] Failed to send datagram to endpoint \"%s\": %s\n", session.n, session.endpoint.Host, err.Error())
+        }
+    }
+}
+
+func (s *udpSessions) get(clientAddr net.Addr) *udpSession {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    return s.sessions[clientAddr.String()]
+}
+
+func (s *udpSessions) put(session *udpSession) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    s.sessions[session.client.String()] = session
+}
+
+func (s *udpSessions) remove(session *udpSession) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    delete(s.sessions, session.client.String())
+}
+
+// Returns nil if the flow is rejected or there is no endpoint to relay it to; its datagrams are dropped then
+func startUDPSession(listener net.PacketConn, clientAddr net.Addr, sessions *udpSessions, data *runtimeData, n int64) *udpSession {
+    release, err := data.clientLimits.admit(clientAddr)
+    if err != nil {
+        data.logger.Printf("[%d] UDP flow from %+v is rejected: %s (%d rate limited in total)\n", n, clientAddr, err.Error(), data.clientLimits.reject())
+        return nil
+    }
+
+    if !data.limits.tryAdmit() {
+        if release != nil {
+            release()
+        }
+        data.logger.Printf("[%d] UDP flow from %+v is rejected: too many sessions (%d rejected in total)\n", n, clientAddr, data.limits.reject())
+        return nil
+    }
+
+    route := data.routes[0]
+
+    endpoint, service, err := dialUDPEndpoint(clientAddr, route, data)
+    if err != nil {
+        data.limits.leave()
+        if release != nil {
+            release()
+        }
+        data.logger.Printf("[%d] UDP flow from %+v is dropped: %s\n", n, clientAddr, err.Error())
+        return nil
+    }
+
+    session := &udpSession{lastActive: time.Now().UnixNano(), n: n, client: clientAddr, endpoint: endpoint, service: service}
+
+    sessions.put(session)
+    data.connections.add(n, service, release)
+
+    if data.verbose {
+        data.logger.Printf("[%d] UDP flow from %+v is relayed to endpoint \"%s\"\n", n, clientAddr, endpoint.Host)
+    }
+
+    go relayUDPResponses(listener, session, sessions, route, data)
+
+    return session
+}
+
+// Endpoints failed to dial are skipped for the rest of the attempts
+func dialUDPEndpoint(clientAddr net.Addr, route *route, data *runtimeData) (*cycle.Endpoint, *net.UDPConn, error) {
+    tried := make(map[*cycle.Endpoint]bool)
+    skipTried := func(endpoint *cycle.Endpoint) bool {
+        return tried[endpoint]
+    }
+
+    err := errors.New("No endpoints")
+
+    for i := 0; i < data.connectPolicy.attempts; i++ {
+        endpoint := route.picker.Pick(clientKey(clientAddr), data.limits.skip(skipTried))
+        if endpoint == nil || tried[endpoint] {
+            break
+        }
+
+        if data.limits.acquire(endpoint) != nil {
+            err = errors.New("All endpoints are at their connection limits")
+            break
+        }
+
+        dialStart := time.Now()
+
+        var service *net.UDPConn
+        if service, err = dialUDP(endpoint.Host); err == nil {
+            route.picker.Connected(endpoint, time.Since(dialStart))
+            return endpoint, service, nil
+        }
+
+        route.picker.Failed(endpoint)
+        data.limits.release(endpoint)
+        tried[endpoint] = true
+    }
+
+    return nil, nil, err
+}
+
+func dialUDP(host string) (*net.UDPConn, error) {
+    addr, err := net.ResolveUDPAddr("udp", host)
+    if err != nil {
+        return nil, err
+    }
+    return net.DialUDP("udp", nil, addr)
+}
+
+// Relays the endpoint datagrams back to the client until the session is idle for the session timeout
+func relayUDPResponses(listener net.PacketConn, session *udpSession, sessions *udpSessions, route *route, data *runtimeData) {
+    defer func() {
+        sessions.remove(session)
+        session.service.Close()
+        route.picker.Disconnected(session.endpoint)
+        data.limits.release(session.endpoint)
+        data.limits.leave()
+        data.connections.remove(session.n)
+    }()
+
+    buffer := make([]byte, maxDatagramSize)
+
+    for {
+        lastActive := time.Unix(0, atomic.LoadInt64(&session.lastActive))
+        session.service.SetReadDeadline(lastActive.Add(data.udpSessionTimeout))
+
+        size, err := session.service.Read(buffer)
+        if err != nil {
+            if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+                if time.Since(time.Unix(0, atomic.LoadInt64(&session.lastActive))) < data.udpSessionTimeout {
+                    continue // There were client datagrams while waiting
+                }
+
+                if data.verbose {
+                    data.logger.Printf("[%d] UDP flow from %+v is idle, closed\n", session.n, session.client)
+                }
+                return
+            }
+
+            select {
+            case <-data.stop:
+            default:
+                data.logger.Printf("[%d] UDP flow from %+v to endpoint \"%s\" failed: %s\n", session.n, session.client, session.endpoint.Host, err.Error())
+                route.picker.Failed(session.endpoint)
+            }
+            return
+        }
+
+        atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+
+        if _, err := listener.WriteTo(buffer[:size], session.client); err != nil {
+            if data.verbose {
+                data.logger.Printf("[%d] Failed to send datagram to %+v: %s\n", session.n, session.client, err.Error())
+            }
+        }
+    }
+}
@@ -10,7 +10,7 @@ project {
     val buildText = "$versionText.0.$buildNumber"
 
     make {
-        on("maxmanuylov/go-build:1.8") {
+        on("maxmanuylov/go-build:1.11") {
             at("/go/src/github.com/maxmanuylov/jongleur")
             withEnv {
                 + "VERSION".to(versionText)
@@ -1,35 +1,110 @@
 package cycle
 
-type Cycle struct {
-    items   []string
-    nextI   int
-    stop    chan bool
+import (
+    "fmt"
+    "strconv"
+    "sync/atomic"
+)
+
+type Item struct {
+    Host       string
+    Weight     int // Items with zero weight are registered but get no new connections
+    Zone       string
+    Priority   int // Lower value means higher priority
+    ServerName string // TLS server name of the endpoint; empty value means the default one
 }
 
-func NewCycle(items []string) *Cycle {
-    if len(items) == 0 {
-        panic("Attempt to create an empty cycle")
+func (item Item) String() string {
+    details := strconv.Itoa(item.Weight)
+    if item.Zone != "" {
+        details += ", zone " + item.Zone
+    }
+    if item.Priority != 0 {
+        details += ", priority " + strconv.Itoa(item.Priority)
+    }
+    if item.ServerName != "" {
+        details += ", server name " + item.ServerName
     }
-    return &Cycle{items, 0, make(chan bool, 1)}
+    return fmt.Sprintf("%s(%s)", item.Host, details)
 }
 
-func (cycle *Cycle) Start(c chan<- string) {
-    go cycle.run(c)
+const maxCycleLength = 4096
+
+// Smooth weighted round-robin: heavy endpoints get their share interleaved with the others rather than in bursts.
+// The order is computed once per endpoints update, so picking is just an atomic increment.
+type Cycle struct {
+    nextI    uint64 // Accessed atomically; kept first for 64-bit alignment
+    sequence []*Endpoint
 }
 
-func (cycle *Cycle) Stop() {
-    cycle.stop <- true
+func newCycle(targets []target) selector {
+    weights := cycleWeights(targets)
+
+    total := 0
+    for _, weight := range weights {
+        total += weight
+    }
+
+    sequence := make([]*Endpoint, 0, total)
+    current := make([]int, len(targets))
+
+    for len(sequence) < total {
+        best := 0
+        for i, weight := range weights {
+            current[i] += weight
+            if current[i] > current[best] {
+                best = i
+            }
+        }
+
+        current[best] -= total
+        sequence = append(sequence, targets[best].endpoint)
+    }
+
+    return &Cycle{sequence: sequence}
 }
 
-func (cycle *Cycle) run(c chan<- string) {
-    for {
-        select {
-        case <-cycle.stop:
-            return
-        default:
-            c <- cycle.items[cycle.nextI]
-            cycle.nextI++
-            cycle.nextI %= len(cycle.items)
+func (cycle *Cycle) pick(client string, skip Skip) *Endpoint {
+    n := uint64(len(cycle.sequence))
+    i := atomic.AddUint64(&cycle.nextI, 1) - 1
+
+    for k := uint64(0); k < n; k++ {
+        endpoint := cycle.sequence[(i + k) % n]
+        if skip == nil || !skip(endpoint) {
+            return endpoint
         }
     }
+
+    return nil
+}
+
+// Weights are reduced by their GCD and scaled down if the sequence would get too long
+func cycleWeights(targets []target) []int {
+    divisor, total := 0, 0
+    for _, target := range targets {
+        divisor = gcd(divisor, target.weight)
+        total += target.weight
+    }
+
+    weights := make([]int, len(targets))
+
+    for i, target := range targets {
+        if total / divisor > maxCycleLength {
+            weights[i] = target.weight * maxCycleLength / total
+            if weights[i] == 0 {
+                weights[i] = 1
+            }
+        } else {
+            weights[i] = target.weight / divisor
+        }
+    }
+
+    return weights
+}
+
+func gcd(a, b int) int {
+    for b != 0 {
+        a, b = b, a % b
+    }
+    return a
 }
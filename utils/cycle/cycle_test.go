@@ -0,0 +1,148 @@
+package cycle
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func newTargets(weights ...int) []target {
+    targets := make([]target, len(weights))
+    for i, weight := range weights {
+        targets[i] = target{newEndpoint(string('a' + rune(i)), time.Time{}), weight}
+    }
+    return targets
+}
+
+func sequenceOf(cycle *Cycle) string {
+    hosts := make([]string, len(cycle.sequence))
+    for i, endpoint := range cycle.sequence {
+        hosts[i] = endpoint.Host
+    }
+    return strings.Join(hosts, "")
+}
+
+func TestCycleInterleavesWeights(t *testing.T) {
+    tests := []struct {
+        weights  []int
+        sequence string
+    }{
+        {[]int{1}, "a"},
+        {[]int{1, 1, 1}, "abc"},
+        {[]int{5, 1, 1}, "aabacaa"},
+        {[]int{2, 1}, "aba"},
+        {[]int{10, 5, 5}, "abca"}, // Reduced by GCD
+    }
+
+    for _, test := range tests {
+        cycle := newCycle(newTargets(test.weights...)).(*Cycle)
+        if sequence := sequenceOf(cycle); sequence != test.sequence {
+            t.Errorf("Weights %v: expected sequence %q, got %q", test.weights, test.sequence, sequence)
+        }
+    }
+}
+
+func TestCyclePicksInSequence(t *testing.T) {
+    cycle := newCycle(newTargets(5, 1, 1)).(*Cycle)
+
+    picked := ""
+    for i := 0; i < 14; i++ {
+        picked += cycle.pick("", nil).Host
+    }
+
+    if picked != "aabacaaaabacaa" {
+        t.Errorf("Unexpected picking order: %q", picked)
+    }
+}
+
+func TestCycleSkipsEndpoints(t *testing.T) {
+    cycle := newCycle(newTargets(5, 1, 1)).(*Cycle)
+    skipA := func(endpoint *Endpoint) bool {
+        return endpoint.Host == "a"
+    }
+
+    for i := 0; i < 7; i++ {
+        if endpoint := cycle.pick("", skipA); endpoint == nil || endpoint.Host == "a" {
+            t.Fatalf("Skipped endpoint is picked: %v", endpoint)
+        }
+    }
+
+    skipAll := func(*Endpoint) bool {
+        return true
+    }
+
+    if endpoint := cycle.pick("", skipAll); endpoint != nil {
+        t.Errorf("Expected no endpoint when all are skipped, got %s", endpoint.Host)
+    }
+}
+
+func TestCycleWeights(t *testing.T) {
+    tests := []struct {
+        weights  []int
+        expected []int
+    }{
+        {[]int{3}, []int{1}},
+        {[]int{4, 2, 2}, []int{2, 1, 1}},
+        {[]int{6, 9}, []int{2, 3}},
+        {[]int{4096, 1}, []int{4095, 1}}, // Scaled down, the light one keeps its minimal share
+        {[]int{10000, 1}, []int{4095, 1}},
+        {[]int{3000, 3000}, []int{1, 1}}, // GCD reduction comes first
+        {[]int{3000, 2000, 1}, []int{2457, 1638, 1}},
+    }
+
+    for _, test := range tests {
+        weights := cycleWeights(newTargets(test.weights...))
+        if !equalInts(weights, test.expected) {
+            t.Errorf("Weights %v: expected %v, got %v", test.weights, test.expected, weights)
+        }
+    }
+}
+
+func TestCycleLengthIsLimited(t *testing.T) {
+    cycle := newCycle(newTargets(10000, 1)).(*Cycle)
+
+    if len(cycle.sequence) > maxCycleLength {
+        t.Fatalf("Cycle length %d exceeds %d", len(cycle.sequence), maxCycleLength)
+    }
+
+    if count := strings.Count(sequenceOf(cycle), "b"); count != 1 {
+        t.Errorf("Expected the light endpoint to be picked once per cycle, got %d", count)
+    }
+}
+
+func TestPickerExcludesZeroWeight(t *testing.T) {
+    picker, err := NewPicker(PickerConfig{Strategy: RoundRobin}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    picker.SyncItems([]Item{{Host: "a", Weight: 1}, {Host: "b", Weight: 0}, {Host: "c", Weight: 2}})
+
+    for i := 0; i < 30; i++ {
+        if endpoint := picker.Pick("", nil); endpoint == nil || endpoint.Host == "b" {
+            t.Fatalf("Unexpected endpoint: %v", endpoint)
+        }
+    }
+
+    if len(picker.Endpoints()) != 3 {
+        t.Errorf("Zero weight endpoint must stay registered")
+    }
+
+    picker.SyncItems([]Item{{Host: "a", Weight: 0}})
+
+    if endpoint := picker.Pick("", nil); endpoint != nil {
+        t.Errorf("Expected no endpoint when all weights are zero, got %s", endpoint.Host)
+    }
+}
+
+func equalInts(a []int, b []int) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,105 @@
+package cycle
+
+import (
+    "sync/atomic"
+    "time"
+)
+
+const maxEjectionShift = 5
+
+// Passive outlier detection: endpoints that fail to accept connections several times in a row are ejected
+// for a time that doubles with every ejection in a row; readmitted endpoint stays on probation until it accepts
+// a connection, and the first failure during probation ejects it again.
+// All the methods below must be called under the picker lock.
+
+func (picker *Picker) suspect(endpoint *Endpoint) {
+    if endpoint.ejected || picker.endpoints[endpoint.Host] != endpoint {
+        return
+    }
+
+    failures := atomic.AddInt32(&endpoint.failures, 1)
+    onProbation := atomic.LoadInt32(&endpoint.probation) != 0
+
+    if !onProbation && int(failures) < picker.config.EjectFailures {
+        return
+    }
+
+    if ejected := picker.countEjected(); (ejected + 1) * 100 > len(picker.endpoints) * picker.config.MaxEjectPercent {
+        if picker.logger != nil {
+            picker.logger.Printf("Endpoint %s keeps failing but is not ejected: %d of %d endpoints are already ejected\n", endpoint.Host, ejected, len(picker.endpoints))
+        }
+        return
+    }
+
+    endpoint.ejections++
+    endpoint.ejected = true
+
+    atomic.StoreInt32(&endpoint.failures, 0)
+    atomic.StoreInt32(&endpoint.probation, 0)
+
+    shift := uint(endpoint.ejections - 1)
+    if shift > maxEjectionShift {
+        shift = maxEjectionShift
+    }
+
+    ejectTime := picker.config.EjectTime << shift
+
+    if picker.logger != nil {
+        if onProbation {
+            picker.logger.Printf("Endpoint %s is ejected for %v after connection failure on probation\n", endpoint.Host, ejectTime)
+        } else {
+            picker.logger.Printf("Endpoint %s is ejected for %v after %d sequential connection failures\n", endpoint.Host, ejectTime, failures)
+        }
+    }
+
+    time.AfterFunc(ejectTime, func() {
+        picker.lock.Lock()
+        defer picker.lock.Unlock()
+
+        picker.readmit(endpoint)
+    })
+
+    picker.publish()
+}
+
+func (picker *Picker) readmit(endpoint *Endpoint) {
+    if !endpoint.ejected || picker.endpoints[endpoint.Host] != endpoint {
+        return
+    }
+
+    endpoint.ejected = false
+    atomic.StoreInt32(&endpoint.probation, 1)
+
+    if picker.logger != nil {
+        picker.logger.Printf("Endpoint %s is readmitted on probation\n", endpoint.Host)
+    }
+
+    picker.publish()
+}
+
+func (picker *Picker) acquit(endpoint *Endpoint) {
+    if atomic.LoadInt32(&endpoint.probation) != 0 {
+        endpoint.ejections = 0
+        atomic.StoreInt32(&endpoint.probation, 0)
+
+        if picker.logger != nil {
+            picker.logger.Printf("Endpoint %s has passed probation\n", endpoint.Host)
+        }
+    }
+
+    atomic.StoreInt32(&endpoint.failures, 0)
+}
+
+func (picker *Picker) countEjected() int {
+    ejected := 0
+    for _, endpoint := range picker.endpoints {
+        if endpoint.ejected {
+            ejected++
+        }
+    }
+    return ejected
+}
+
+func (endpoint *Endpoint) isSuspected() bool {
+    return atomic.LoadInt32(&endpoint.failures) != 0 || atomic.LoadInt32(&endpoint.probation) != 0
+}
@@ -0,0 +1,155 @@
+package cycle
+
+import (
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+const testEjectTime = 50 * time.Millisecond
+
+func newEjectionPicker(t *testing.T, ejectFailures int, maxEjectPercent int, hosts ...string) (*Picker, map[string]*Endpoint) {
+    picker, err := NewPicker(PickerConfig{
+        Strategy: RoundRobin,
+        EjectFailures: ejectFailures,
+        EjectTime: testEjectTime,
+        MaxEjectPercent: maxEjectPercent,
+    }, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    items := make([]Item, len(hosts))
+    for i, host := range hosts {
+        items[i] = Item{Host: host, Weight: 1}
+    }
+
+    picker.SyncItems(items)
+
+    endpoints := make(map[string]*Endpoint)
+    for _, endpoint := range picker.Endpoints() {
+        endpoints[endpoint.Host] = endpoint
+    }
+
+    return picker, endpoints
+}
+
+func isEjected(picker *Picker, endpoint *Endpoint) bool {
+    picker.lock.Lock()
+    defer picker.lock.Unlock()
+
+    return endpoint.ejected
+}
+
+func ejections(picker *Picker, endpoint *Endpoint) int {
+    picker.lock.Lock()
+    defer picker.lock.Unlock()
+
+    return endpoint.ejections
+}
+
+func isPicked(picker *Picker, endpoint *Endpoint, picks int) bool {
+    for i := 0; i < picks; i++ {
+        if picker.Pick("", nil) == endpoint {
+            return true
+        }
+    }
+    return false
+}
+
+func TestEjectionThreshold(t *testing.T) {
+    tests := []struct {
+        ejectFailures   int
+        maxEjectPercent int
+        failures        int
+        successAfter    int // Successful dial after this number of failures resets the count; -1 means none
+        ejected         bool
+    }{
+        {3, 100, 2, -1, false},
+        {3, 100, 3, -1, true},
+        {1, 100, 1, -1, true},
+        {3, 100, 4, 2, false}, // Failures must be sequential
+        {3, 100, 5, 2, true},
+        {0, 100, 10, -1, false}, // Ejection is disabled
+        {3, 25, 3, -1, false}, // One of two endpoints is over the maximum ejection percent
+        {3, 50, 3, -1, true},
+    }
+
+    for _, test := range tests {
+        picker, endpoints := newEjectionPicker(t, test.ejectFailures, test.maxEjectPercent, "a", "b")
+        endpoint := endpoints["a"]
+
+        for i := 0; i < test.failures; i++ {
+            if i == test.successAfter {
+                picker.Connected(endpoint, time.Millisecond)
+                picker.Disconnected(endpoint)
+            }
+            picker.Failed(endpoint)
+        }
+
+        if ejected := isEjected(picker, endpoint); ejected != test.ejected {
+            t.Errorf("%+v: expected ejected %v, got %v", test, test.ejected, ejected)
+        }
+
+        if picked := isPicked(picker, endpoint, 10); picked == test.ejected {
+            t.Errorf("%+v: endpoint picked %v while ejected %v", test, picked, test.ejected)
+        }
+    }
+}
+
+func TestProbationAndEjectionBackoff(t *testing.T) {
+    picker, endpoints := newEjectionPicker(t, 2, 100, "a", "b")
+    endpoint := endpoints["a"]
+
+    steps := []struct {
+        name       string
+        action     func()
+        wait       time.Duration
+        ejected    bool
+        ejections  int
+        probation  bool
+    }{
+        {"ejected after failures", func() { picker.Failed(endpoint); picker.Failed(endpoint) }, 0, true, 1, false},
+        {"readmitted on probation", nil, testEjectTime * 2, false, 1, true},
+        {"ejected on the first failure on probation", func() { picker.Failed(endpoint) }, 0, true, 2, false},
+        {"not readmitted before doubled time", nil, testEjectTime * 3 / 2, true, 2, false},
+        {"readmitted after doubled time", nil, testEjectTime * 2, false, 2, true},
+        {"acquitted after successful dial", func() { picker.Connected(endpoint, time.Millisecond) }, 0, false, 0, false},
+        {"not ejected after one failure when acquitted", func() { picker.Failed(endpoint) }, 0, false, 0, false},
+        {"ejected with the first time again", func() { picker.Failed(endpoint) }, 0, true, 1, false},
+        {"readmitted after the first time", nil, testEjectTime * 2, false, 1, true},
+    }
+
+    for _, step := range steps {
+        if step.action != nil {
+            step.action()
+        }
+
+        time.Sleep(step.wait)
+
+        if ejected := isEjected(picker, endpoint); ejected != step.ejected {
+            t.Fatalf("%s: expected ejected %v, got %v", step.name, step.ejected, ejected)
+        }
+
+        if n := ejections(picker, endpoint); n != step.ejections {
+            t.Fatalf("%s: expected %d ejections in a row, got %d", step.name, step.ejections, n)
+        }
+
+        if probation := atomic.LoadInt32(&endpoint.probation) != 0; probation != step.probation {
+            t.Fatalf("%s: expected probation %v, got %v", step.name, step.probation, probation)
+        }
+    }
+}
+
+func TestRemovedEndpointIsNotReadmitted(t *testing.T) {
+    picker, endpoints := newEjectionPicker(t, 1, 100, "a", "b")
+
+    picker.Failed(endpoints["a"])
+    picker.SyncItems([]Item{{Host: "b", Weight: 1}})
+
+    time.Sleep(testEjectTime * 2)
+
+    if isPicked(picker, endpoints["a"], 10) {
+        t.Error("Removed endpoint is picked after readmission")
+    }
+}
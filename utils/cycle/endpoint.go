@@ -0,0 +1,79 @@
+package cycle
+
+import (
+    "math"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const latencyDecay = 10 * time.Second
+
+// Runtime state of a registered host; it survives endpoints updates as long as the host stays registered
+type Endpoint struct {
+    active    int64  // Accessed atomically; 64-bit fields are kept first for alignment
+    latency   uint64 // math.Float64bits() of dial time EWMA in nanoseconds, failed dials included; accessed atomically
+    failures  int32  // Sequential dial failures; accessed atomically, changed under the picker lock
+    probation int32  // Non-zero after readmission until the first successful dial; same access rules as failures
+
+    Host       string
+    serverName atomic.Value // string; follows the item updates
+
+    added     time.Time // Zero for the endpoints that are not subject to slow start
+    dialed    time.Time
+    lock      *sync.Mutex // Guards latency updates, reads are lock-free
+
+    ejected   bool // Guarded by the picker lock
+    ejections int  // Ejections in a row; guarded by the picker lock
+    down      bool // Set by active health checks; guarded by the picker lock
+}
+
+func newEndpoint(host string, added time.Time) *Endpoint {
+    return &Endpoint{Host: host, added: added, lock: &sync.Mutex{}}
+}
+
+func (endpoint *Endpoint) connected(dialTime time.Duration) {
+    atomic.AddInt64(&endpoint.active, 1)
+    endpoint.sample(dialTime)
+}
+
+// Failed dials are sampled with the penalty, so that an endpoint not accepting connections gets a high latency
+func (endpoint *Endpoint) failed(penalty time.Duration) {
+    if penalty > 0 {
+        endpoint.sample(penalty)
+    }
+}
+
+func (endpoint *Endpoint) sample(dialTime time.Duration) {
+    endpoint.lock.Lock()
+    defer endpoint.lock.Unlock()
+
+    now := time.Now()
+
+    latency := float64(dialTime)
+    if !endpoint.dialed.IsZero() {
+        w := math.Exp(-float64(now.Sub(endpoint.dialed)) / float64(latencyDecay))
+        latency = endpoint.Latency() * w + latency * (1 - w)
+    }
+
+    atomic.StoreUint64(&endpoint.latency, math.Float64bits(latency))
+    endpoint.dialed = now
+}
+
+func (endpoint *Endpoint) disconnected() {
+    atomic.AddInt64(&endpoint.active, -1)
+}
+
+func (endpoint *Endpoint) ServerName() string {
+    serverName, _ := endpoint.serverName.Load().(string)
+    return serverName
+}
+
+func (endpoint *Endpoint) Active() int64 {
+    return atomic.LoadInt64(&endpoint.active)
+}
+
+// Zero means the endpoint has not been dialed yet
+func (endpoint *Endpoint) Latency() float64 {
+    return math.Float64frombits(atomic.LoadUint64(&endpoint.latency))
+}
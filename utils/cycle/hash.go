@@ -0,0 +1,87 @@
+package cycle
+
+import (
+    "fmt"
+    "hash/fnv"
+    "sort"
+)
+
+const (
+    pointsPerWeight   = 160
+    maxEndpointPoints = 100 * pointsPerWeight // Weights above 100 get the same share as 100
+)
+
+type ringPoint struct {
+    hash     uint64
+    endpoint *Endpoint
+}
+
+// Consistent hashing ring: every endpoint owns a number of points proportional to its weight,
+// so adding or removing an endpoint moves only the clients that hash next to its points.
+// The points of an endpoint do not depend on the other endpoints, so they never move when the others change.
+type ring []ringPoint
+
+func newRing(targets []target) selector {
+    points := make(ring, 0)
+
+    for _, t := range targets {
+        n := t.weight * pointsPerWeight
+        if n > maxEndpointPoints {
+            n = maxEndpointPoints
+        }
+
+        for i := 0; i < n; i++ {
+            points = append(points, ringPoint{hashOf(fmt.Sprintf("%s#%d", t.endpoint.Host, i)), t.endpoint})
+        }
+    }
+
+    sort.Sort(points)
+
+    return points
+}
+
+// Skipped endpoints are passed by walking the ring clockwise, so the next choice is stable as well
+func (points ring) pick(client string, skip Skip) *Endpoint {
+    hash := hashOf(client)
+
+    i := sort.Search(len(points), func(i int) bool {
+        return points[i].hash >= hash
+    })
+
+    for k := 0; k < len(points); k++ {
+        endpoint := points[(i + k) % len(points)].endpoint
+        if skip == nil || !skip(endpoint) {
+            return endpoint
+        }
+    }
+
+    return nil
+}
+
+func (points ring) Len() int {
+    return len(points)
+}
+
+func (points ring) Less(i, j int) bool {
+    return points[i].hash < points[j].hash
+}
+
+func (points ring) Swap(i, j int) {
+    points[i], points[j] = points[j], points[i]
+}
+
+func hashOf(s string) uint64 {
+    h := fnv.New64a()
+    h.Write([]byte(s))
+    return mix(h.Sum64()) // FNV alone spreads similar short strings poorly
+}
+
+// MurmurHash3 finalizer
+func mix(x uint64) uint64 {
+    x ^= x >> 33
+    x *= 0xff51afd7ed558ccd
+    x ^= x >> 33
+    x *= 0xc4ceb9fe1a85ec53
+    x ^= x >> 33
+    return x
+}
@@ -0,0 +1,87 @@
+package cycle
+
+import (
+    "strconv"
+    "testing"
+    "time"
+)
+
+func ringAssignments(targets []target, clients int) []*Endpoint {
+    selector := newRing(targets)
+
+    assignments := make([]*Endpoint, clients)
+    for i := range assignments {
+        assignments[i] = selector.pick("10." + strconv.Itoa(i / 65536) + "." + strconv.Itoa(i / 256 % 256) + "." + strconv.Itoa(i % 256), nil)
+    }
+    return assignments
+}
+
+func TestRingMovesOnlyChangedEndpointClients(t *testing.T) {
+    const clients = 20000
+
+    endpoints := make(map[string]*Endpoint)
+    targetsOf := func(weights map[string]int) []target {
+        targets := make([]target, 0, len(weights))
+        for host, weight := range weights {
+            if endpoints[host] == nil {
+                endpoints[host] = newEndpoint(host, time.Time{})
+            }
+            targets = append(targets, target{endpoints[host], weight})
+        }
+        return targets
+    }
+
+    tests := []struct {
+        name    string
+        before  map[string]int
+        after   map[string]int
+        changed string // The only endpoint clients may move to or from
+        share   float64 // Expected share of the moved clients
+    }{
+        {"heavy endpoint added", map[string]int{"a": 1, "b": 1, "c": 1, "d": 1}, map[string]int{"a": 1, "b": 1, "c": 1, "d": 1, "e": 4}, "e", 0.5},
+        {"heavy endpoint removed", map[string]int{"a": 3, "b": 1, "c": 1, "d": 1}, map[string]int{"b": 1, "c": 1, "d": 1}, "a", 0.5},
+        {"light endpoint removed", map[string]int{"a": 3, "b": 1, "c": 1, "d": 1}, map[string]int{"a": 3, "c": 1, "d": 1}, "b", 1.0 / 6},
+        {"endpoint weight raised", map[string]int{"a": 1, "b": 1}, map[string]int{"a": 1, "b": 3}, "b", 0.25},
+    }
+
+    for _, test := range tests {
+        before := ringAssignments(targetsOf(test.before), clients)
+        after := ringAssignments(targetsOf(test.after), clients)
+
+        moved := 0
+        for i := range before {
+            if before[i] == after[i] {
+                continue
+            }
+
+            moved++
+
+            if before[i].Host != test.changed && after[i].Host != test.changed {
+                t.Errorf("%s: client %d moved from %s to %s", test.name, i, before[i].Host, after[i].Host)
+                break
+            }
+        }
+
+        if share := float64(moved) / clients; share < test.share * 0.75 || share > test.share * 1.25 {
+            t.Errorf("%s: %.0f%% of clients moved, expected about %.0f%%", test.name, share * 100, test.share * 100)
+        }
+    }
+}
+
+func TestRingSharesFollowWeights(t *testing.T) {
+    const clients = 20000
+
+    targets := newTargets(1, 2, 4)
+    counts := make(map[string]int)
+
+    for _, endpoint := range ringAssignments(targets, clients) {
+        counts[endpoint.Host]++
+    }
+
+    for i, expected := range []float64{1.0 / 7, 2.0 / 7, 4.0 / 7} {
+        host := targets[i].endpoint.Host
+        if share := float64(counts[host]) / clients; share < expected * 0.75 || share > expected * 1.25 {
+            t.Errorf("Endpoint %s with weight %d got %.0f%% of clients, expected about %.0f%%", host, targets[i].weight, share * 100, expected * 100)
+        }
+    }
+}
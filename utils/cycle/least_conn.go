@@ -0,0 +1,41 @@
+package cycle
+
+import "sync/atomic"
+
+// Picks the endpoint with the fewest active connections relative to its weight; ties are broken in round-robin manner
+type leastConn struct {
+    nextI   uint64 // Accessed atomically
+    targets []target
+}
+
+func newLeastConn(targets []target) selector {
+    return &leastConn{targets: targets}
+}
+
+func (lc *leastConn) pick(client string, skip Skip) *Endpoint {
+    n := uint64(len(lc.targets))
+    start := atomic.AddUint64(&lc.nextI, 1) - 1
+
+    var (
+        best       *target
+        bestActive int64
+    )
+
+    for k := uint64(0); k < n; k++ {
+        t := &lc.targets[(start + k) % n]
+        if skip != nil && skip(t.endpoint) {
+            continue
+        }
+
+        active := t.endpoint.Active()
+        if best == nil || active * int64(best.weight) < bestActive * int64(t.weight) {
+            best, bestActive = t, active
+        }
+    }
+
+    if best == nil {
+        return nil
+    }
+
+    return best.endpoint
+}
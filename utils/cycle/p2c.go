@@ -0,0 +1,93 @@
+package cycle
+
+import (
+    "sync/atomic"
+    "time"
+)
+
+// "Power of two choices": samples two random endpoints and picks the one with the lower load,
+// where load is dial time EWMA multiplied by the number of active connections and divided by weight.
+// Endpoints not dialed yet get the mean load of the dialed ones, so that they neither win nor lose every comparison.
+type p2c struct {
+    seed    uint64 // Accessed atomically
+    targets []target
+}
+
+func newP2C(targets []target) selector {
+    return &p2c{seed: uint64(time.Now().UnixNano()), targets: targets}
+}
+
+func (pc *p2c) pick(client string, skip Skip) *Endpoint {
+    targets := pc.targets
+
+    if skip != nil {
+        targets = make([]target, 0, len(pc.targets))
+        for _, t := range pc.targets {
+            if !skip(t.endpoint) {
+                targets = append(targets, t)
+            }
+        }
+    }
+
+    n := uint64(len(targets))
+    switch n {
+    case 0:
+        return nil
+    case 1:
+        return targets[0].endpoint
+    }
+
+    random := mix(atomic.AddUint64(&pc.seed, 0x9e3779b97f4a7c15))
+
+    i := random % n
+    j := (random >> 32) % (n - 1)
+    if j >= i {
+        j++
+    }
+
+    costI, dialedI := cost(targets[i])
+    costJ, dialedJ := cost(targets[j])
+
+    if !dialedI || !dialedJ {
+        mean := meanCost(targets)
+        if !dialedI {
+            costI = mean
+        }
+        if !dialedJ {
+            costJ = mean
+        }
+    }
+
+    if costJ < costI {
+        i = j
+    }
+
+    return targets[i].endpoint
+}
+
+// Returns false if the endpoint is not dialed yet
+func cost(t target) (float64, bool) {
+    latency := t.endpoint.Latency()
+    if latency == 0 {
+        return 0, false
+    }
+    return (latency + 1) * float64(t.endpoint.Active() + 1) / float64(t.weight), true
+}
+
+// Zero if none of the endpoints is dialed yet
+func meanCost(targets []target) float64 {
+    total, dialed := 0.0, 0
+
+    for _, t := range targets {
+        if c, ok := cost(t); ok {
+            total += c
+            dialed++
+        }
+    }
+
+    if dialed == 0 {
+        return 0
+    }
+
+    return total / float64(dialed)
+}
@@ -0,0 +1,77 @@
+package cycle
+
+import (
+    "testing"
+    "time"
+)
+
+func newP2CPicker(t *testing.T, hosts ...string) (*Picker, map[string]*Endpoint) {
+    picker, err := NewPicker(PickerConfig{Strategy: P2C, FailurePenalty: 2 * time.Second}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    items := make([]Item, len(hosts))
+    for i, host := range hosts {
+        items[i] = Item{Host: host, Weight: 1}
+    }
+
+    picker.SyncItems(items)
+
+    endpoints := make(map[string]*Endpoint)
+    for _, endpoint := range picker.Endpoints() {
+        endpoints[endpoint.Host] = endpoint
+    }
+
+    return picker, endpoints
+}
+
+func pickShares(picker *Picker, picks int) map[string]float64 {
+    shares := make(map[string]float64)
+    for i := 0; i < picks; i++ {
+        shares[picker.Pick("", nil).Host] += 1 / float64(picks)
+    }
+    return shares
+}
+
+func TestP2CAvoidsFailingEndpoint(t *testing.T) {
+    picker, endpoints := newP2CPicker(t, "a", "b", "c", "dead")
+
+    for _, host := range []string{"a", "b", "c"} {
+        picker.Connected(endpoints[host], time.Millisecond)
+        picker.Disconnected(endpoints[host])
+    }
+
+    picker.Failed(endpoints["dead"]) // Ejection is disabled, so only the latency tells it is dead
+
+    if latency := time.Duration(endpoints["dead"].Latency()); latency != 2 * time.Second {
+        t.Errorf("Failed dial must be sampled with the penalty, got %v", latency)
+    }
+
+    if share := pickShares(picker, 10000)["dead"]; share > 0.01 {
+        t.Errorf("Failing endpoint got %.0f%% of the picks", share * 100)
+    }
+}
+
+func TestP2CNewEndpointGetsNeutralCost(t *testing.T) {
+    picker, endpoints := newP2CPicker(t, "a", "b", "c", "new")
+
+    for _, host := range []string{"a", "b", "c"} {
+        picker.Connected(endpoints[host], time.Millisecond)
+        picker.Disconnected(endpoints[host])
+    }
+
+    // Mean cost ties with the others, so the new endpoint is kept only when sampled first: 1/4 of the picks
+    if share := pickShares(picker, 10000)["new"]; share < 0.15 || share > 0.35 {
+        t.Errorf("Endpoint not dialed yet got %.0f%% of the picks, expected about 25%%", share * 100)
+    }
+}
+
+func TestP2CWithoutDialedEndpoints(t *testing.T) {
+    picker, _ := newP2CPicker(t, "a", "b")
+
+    shares := pickShares(picker, 1000)
+    if shares["a"] == 0 || shares["b"] == 0 {
+        t.Errorf("Both endpoints must be picked before any dial, got %v", shares)
+    }
+}
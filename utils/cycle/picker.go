@@ -0,0 +1,232 @@
+package cycle
+
+import (
+    "errors"
+    "log"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+type PickerConfig struct {
+    Strategy        string
+    EjectFailures   int // Sequential dial failures to eject an endpoint after; zero disables ejection
+    EjectTime       time.Duration // The first ejection time; it doubles for every next ejection in a row
+    MaxEjectPercent int
+    LocalZone       string // Endpoints of this zone are preferred; empty value disables zone-aware routing
+    ZoneMinHealthy  int // Percentage of the local zone endpoints that must be available to not spill over to other zones
+    SlowStart       time.Duration // Time for the share of a newly registered endpoint to grow to normal; zero disables slow start
+    FailurePenalty  time.Duration // Dial time recorded for failed dials, usually the connect timeout
+}
+
+type target struct {
+    endpoint *Endpoint
+    weight   int
+}
+
+type snapshot struct {
+    targets  []target
+    selector selector
+}
+
+// Picker selects endpoints synchronously from an immutable snapshot which is atomically replaced on every update,
+// so picking never takes a lock and never waits
+type Picker struct {
+    current     atomic.Value // *snapshot
+    newSelector func([]target) selector
+    config      PickerConfig
+
+    items       []Item
+    index       map[string]Item
+    endpoints   map[string]*Endpoint
+    priority    int
+    hasPriority bool
+    spillover   bool
+    rampTimer   *time.Timer
+    logger      *log.Logger
+
+    lock        *sync.Mutex // Serializes updates
+}
+
+func NewPicker(config PickerConfig, logger *log.Logger) (*Picker, error) {
+    newSelector, err := selectorFactory(config.Strategy)
+    if err != nil {
+        return nil, err
+    }
+
+    if config.EjectFailures > 0 && config.EjectTime <= 0 {
+        return nil, errors.New("Ejection time must be positive")
+    }
+
+    if config.MaxEjectPercent < 0 || config.MaxEjectPercent > 100 {
+        return nil, errors.New("Maximum ejection percent must be in range [0, 100]")
+    }
+
+    if config.ZoneMinHealthy < 0 || config.ZoneMinHealthy > 100 {
+        return nil, errors.New("Zone minimum healthy percent must be in range [0, 100]")
+    }
+
+    picker := &Picker{
+        newSelector: newSelector,
+        config: config,
+        endpoints: make(map[string]*Endpoint),
+        logger: logger,
+        lock: &sync.Mutex{},
+    }
+
+    picker.current.Store(&snapshot{})
+
+    return picker, nil
+}
+
+// Endpoints for which skip returns true are picked only if there are no other ones; skip can be nil.
+// Returns nil if there are no endpoints to pick from.
+func (picker *Picker) Pick(client string, skip Skip) *Endpoint {
+    current := picker.current.Load().(*snapshot)
+    if len(current.targets) == 0 {
+        return nil
+    }
+
+    if skip != nil {
+        if endpoint := current.selector.pick(client, skip); endpoint != nil {
+            return endpoint
+        }
+    }
+
+    return current.selector.pick(client, nil)
+}
+
+func (picker *Picker) Connected(endpoint *Endpoint, dialTime time.Duration) {
+    endpoint.connected(dialTime)
+
+    if endpoint.isSuspected() {
+        picker.lock.Lock()
+        defer picker.lock.Unlock()
+
+        picker.acquit(endpoint)
+    }
+}
+
+func (picker *Picker) Disconnected(endpoint *Endpoint) {
+    endpoint.disconnected()
+}
+
+func (picker *Picker) Failed(endpoint *Endpoint) {
+    endpoint.failed(picker.config.FailurePenalty)
+
+    if picker.config.EjectFailures <= 0 {
+        return
+    }
+
+    picker.lock.Lock()
+    defer picker.lock.Unlock()
+
+    picker.suspect(endpoint)
+}
+
+// Endpoints marked down are excluded from picking until marked up again
+func (picker *Picker) SetDown(endpoint *Endpoint, down bool) {
+    picker.lock.Lock()
+    defer picker.lock.Unlock()
+
+    if endpoint.down == down || picker.endpoints[endpoint.Host] != endpoint {
+        return
+    }
+
+    endpoint.down = down
+
+    picker.publish()
+}
+
+// All the registered endpoints including the excluded ones
+func (picker *Picker) Endpoints() []*Endpoint {
+    picker.lock.Lock()
+    defer picker.lock.Unlock()
+
+    endpoints := make([]*Endpoint, 0, len(picker.endpoints))
+    for _, endpoint := range picker.endpoints {
+        endpoints = append(endpoints, endpoint)
+    }
+
+    return endpoints
+}
+
+func (picker *Picker) SyncItems(newItems []Item) {
+    picker.lock.Lock()
+    defer picker.lock.Unlock()
+
+    if !itemsDiffer(picker.index, newItems) {
+        return
+    }
+
+    logger := picker.logger
+    if logger != nil {
+        logger.Printf("Updating endpoints: %v\n", newItems)
+    }
+
+    index := make(map[string]Item)
+    endpoints := make(map[string]*Endpoint)
+
+    for _, item := range newItems {
+        index[item.Host] = item
+
+        if endpoint, ok := picker.endpoints[item.Host]; ok {
+            endpoints[item.Host] = endpoint
+        } else if picker.index == nil {
+            endpoints[item.Host] = newEndpoint(item.Host, time.Time{}) // Endpoints known on start are not new
+        } else {
+            endpoints[item.Host] = newEndpoint(item.Host, time.Now())
+        }
+
+        endpoints[item.Host].serverName.Store(item.ServerName)
+    }
+
+    picker.items = newItems
+    picker.index = index
+    picker.endpoints = endpoints
+
+    picker.publish()
+
+    if logger != nil {
+        logger.Println("Endpoints are updated")
+    }
+}
+
+func (picker *Picker) publish() {
+    targets := make([]target, 0, len(picker.items))
+
+    for _, item := range picker.items {
+        if endpoint := picker.endpoints[item.Host]; item.Weight > 0 && !endpoint.ejected && !endpoint.down {
+            targets = append(targets, target{endpoint, item.Weight})
+        }
+    }
+
+    targets = picker.selectPriorityGroup(targets)
+    targets = picker.preferLocalZone(targets)
+    targets = picker.applySlowStart(targets)
+
+    newSnapshot := &snapshot{targets: targets}
+    if len(targets) != 0 {
+        newSnapshot.selector = picker.newSelector(targets)
+    }
+
+    picker.current.Store(newSnapshot)
+}
+
+func itemsDiffer(index map[string]Item, newItems []Item) bool {
+    if index == nil {
+        return len(newItems) != 0
+    }
+
+    if len(newItems) != len(index) {
+        return true
+    }
+
+    for _, item := range newItems {
+        if oldItem, ok := index[item.Host]; !ok || oldItem != item {
+            return true
+        }
+    }
+
+    return false
+}
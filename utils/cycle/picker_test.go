@@ -0,0 +1,190 @@
+package cycle
+
+import (
+    "strconv"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+const benchmarkEndpoints = 16
+
+// The channel-driven cycle the picker replaced: a goroutine feeds the hosts to an unbuffered channel
+// and every connection waits for the next host for up to a second
+type channelCycle struct {
+    hosts chan string
+    stop  chan struct{}
+}
+
+func newChannelCycle(hosts []string) *channelCycle {
+    cycle := &channelCycle{hosts: make(chan string), stop: make(chan struct{})}
+
+    if len(hosts) != 0 {
+        go func() {
+            for i := 0; ; i = (i + 1) % len(hosts) {
+                select {
+                case cycle.hosts <- hosts[i]:
+                case <-cycle.stop:
+                    return
+                }
+            }
+        }()
+    }
+
+    return cycle
+}
+
+func (cycle *channelCycle) next() (string, bool) {
+    select {
+    case host := <-cycle.hosts:
+        return host, true
+    case <-time.After(time.Second):
+        return "", false
+    }
+}
+
+func benchmarkItems() []Item {
+    items := make([]Item, benchmarkEndpoints)
+    for i := range items {
+        items[i] = Item{Host: "10.0.0." + strconv.Itoa(i + 1) + ":80", Weight: 1 + i % 3}
+    }
+    return items
+}
+
+func newBenchmarkPicker(b *testing.B, strategy string, items []Item) *Picker {
+    picker, err := NewPicker(PickerConfig{Strategy: strategy}, nil)
+    if err != nil {
+        b.Fatal(err)
+    }
+    picker.SyncItems(items)
+    return picker
+}
+
+func BenchmarkChannelCycle(b *testing.B) {
+    items := benchmarkItems()
+    hosts := make([]string, len(items))
+    for i, item := range items {
+        hosts[i] = item.Host
+    }
+
+    cycle := newChannelCycle(hosts)
+    defer close(cycle.stop)
+
+    b.ResetTimer()
+
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            if _, ok := cycle.next(); !ok {
+                b.Fatal("No host")
+            }
+        }
+    })
+}
+
+func BenchmarkPicker(b *testing.B) {
+    for _, strategy := range []string{RoundRobin, LeastConn, Hash, P2C} {
+        b.Run(strategy, func(b *testing.B) {
+            picker := newBenchmarkPicker(b, strategy, benchmarkItems())
+            var clients int64
+
+            b.ResetTimer()
+
+            b.RunParallel(func(pb *testing.PB) {
+                client := "192.168.0." + strconv.FormatInt(atomic.AddInt64(&clients, 1), 10)
+                for pb.Next() {
+                    if picker.Pick(client, nil) == nil {
+                        b.Fatal("No endpoint")
+                    }
+                }
+            })
+        })
+    }
+}
+
+func BenchmarkChannelCycleEmpty(b *testing.B) {
+    cycle := newChannelCycle(nil)
+    defer close(cycle.stop)
+
+    for i := 0; i < b.N; i++ {
+        if _, ok := cycle.next(); ok {
+            b.Fatal("Unexpected host")
+        }
+    }
+}
+
+func BenchmarkPickerEmpty(b *testing.B) {
+    for _, strategy := range []string{RoundRobin, LeastConn, Hash, P2C} {
+        b.Run(strategy, func(b *testing.B) {
+            picker := newBenchmarkPicker(b, strategy, nil)
+
+            b.RunParallel(func(pb *testing.PB) {
+                for pb.Next() {
+                    if picker.Pick("192.168.0.1", nil) != nil {
+                        b.Fatal("Unexpected endpoint")
+                    }
+                }
+            })
+        })
+    }
+}
+
+func TestPickerEmptyFailsImmediately(t *testing.T) {
+    for _, strategy := range []string{RoundRobin, LeastConn, Hash, P2C} {
+        picker, err := NewPicker(PickerConfig{Strategy: strategy}, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        picker.SyncItems(benchmarkItems())
+        picker.SyncItems(nil)
+
+        start := time.Now()
+
+        if endpoint := picker.Pick("192.168.0.1", nil); endpoint != nil {
+            t.Errorf("%s: expected no endpoint, got %s", strategy, endpoint.Host)
+        }
+
+        if elapsed := time.Since(start); elapsed > 100 * time.Millisecond {
+            t.Errorf("%s: picking from an empty set took %v", strategy, elapsed)
+        }
+    }
+}
+
+func TestPickSkipsTriedEndpoints(t *testing.T) {
+    items := []Item{{Host: "a", Weight: 1}, {Host: "b", Weight: 5}, {Host: "c", Weight: 1}, {Host: "d", Weight: 2}}
+
+    for _, strategy := range []string{RoundRobin, LeastConn, Hash, P2C} {
+        picker, err := NewPicker(PickerConfig{Strategy: strategy}, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        picker.SyncItems(items)
+
+        for attempt := 0; attempt < 50; attempt++ {
+            client := "192.168.0." + strconv.Itoa(attempt)
+            tried := make(map[*Endpoint]bool)
+            skip := func(endpoint *Endpoint) bool {
+                return tried[endpoint]
+            }
+
+            for len(tried) < len(items) {
+                endpoint := picker.Pick(client, skip)
+                if endpoint == nil {
+                    t.Fatalf("%s: no endpoint is picked", strategy)
+                }
+
+                if tried[endpoint] {
+                    t.Fatalf("%s: tried endpoint %s is picked again while %d are untried", strategy, endpoint.Host, len(items) - len(tried))
+                }
+
+                tried[endpoint] = true
+            }
+
+            // All the endpoints are tried, so the skipped ones are picked again
+            if picker.Pick(client, skip) == nil {
+                t.Fatalf("%s: no endpoint is picked after all are tried", strategy)
+            }
+        }
+    }
+}
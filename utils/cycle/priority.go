@@ -0,0 +1,35 @@
+package cycle
+
+// Keeps only the targets of the highest priority group that has available endpoints; must be called under the picker lock
+func (picker *Picker) selectPriorityGroup(targets []target) []target {
+    if len(targets) == 0 {
+        return targets
+    }
+
+    priority := picker.index[targets[0].endpoint.Host].Priority
+    for _, t := range targets {
+        if p := picker.index[t.endpoint.Host].Priority; p < priority {
+            priority = p
+        }
+    }
+
+    if picker.hasPriority && priority != picker.priority && picker.logger != nil {
+        if priority > picker.priority {
+            picker.logger.Printf("Failing over from priority group %d to %d\n", picker.priority, priority)
+        } else {
+            picker.logger.Printf("Failing back from priority group %d to %d\n", picker.priority, priority)
+        }
+    }
+
+    picker.priority = priority
+    picker.hasPriority = true
+
+    groupTargets := make([]target, 0, len(targets))
+    for _, t := range targets {
+        if picker.index[t.endpoint.Host].Priority == priority {
+            groupTargets = append(groupTargets, t)
+        }
+    }
+
+    return groupTargets
+}
@@ -0,0 +1,34 @@
+package cycle
+
+import "fmt"
+
+const (
+    RoundRobin = "round-robin"
+    LeastConn  = "least-conn"
+    Hash       = "hash"
+    P2C        = "p2c"
+)
+
+// Returns true for the endpoints that must not be picked
+type Skip func(*Endpoint) bool
+
+// Selector is built for a non-empty list of targets and must be safe for concurrent use;
+// it returns nil if all the targets are skipped
+type selector interface {
+    pick(client string, skip Skip) *Endpoint // Client is the key for the strategies with sticky sessions
+}
+
+func selectorFactory(strategy string) (func([]target) selector, error) {
+    switch strategy {
+    case RoundRobin:
+        return newCycle, nil
+    case LeastConn:
+        return newLeastConn, nil
+    case Hash:
+        return newRing, nil
+    case P2C:
+        return newP2C, nil
+    default:
+        return nil, fmt.Errorf("Unknown balancing strategy: %s", strategy)
+    }
+}
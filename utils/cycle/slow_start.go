@@ -0,0 +1,58 @@
+package cycle
+
+import "time"
+
+const (
+    slowStartSteps = 20
+    slowStartScale = 100 // Weights are scaled to make small shares expressible
+)
+
+// Reduces the weights of the recently registered endpoints in proportion to their age and schedules the next update
+// while any endpoint is ramping up; must be called under the picker lock
+func (picker *Picker) applySlowStart(targets []target) []target {
+    window := picker.config.SlowStart
+    if window <= 0 {
+        return targets
+    }
+
+    now := time.Now()
+
+    ramping := false
+    for _, t := range targets {
+        if !t.endpoint.added.IsZero() && now.Sub(t.endpoint.added) < window {
+            ramping = true
+            break
+        }
+    }
+
+    if !ramping {
+        return targets
+    }
+
+    rampedTargets := make([]target, len(targets))
+
+    for i, t := range targets {
+        weight := t.weight * slowStartScale
+
+        if age := now.Sub(t.endpoint.added); !t.endpoint.added.IsZero() && age < window {
+            weight = int(int64(weight) * int64(age) / int64(window))
+            if weight == 0 {
+                weight = 1
+            }
+        }
+
+        rampedTargets[i] = target{t.endpoint, weight}
+    }
+
+    if picker.rampTimer == nil {
+        picker.rampTimer = time.AfterFunc(window / slowStartSteps, func() {
+            picker.lock.Lock()
+            defer picker.lock.Unlock()
+
+            picker.rampTimer = nil
+            picker.publish()
+        })
+    }
+
+    return rampedTargets
+}
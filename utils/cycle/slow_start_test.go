@@ -0,0 +1,71 @@
+package cycle
+
+import (
+    "testing"
+    "time"
+)
+
+func TestSlowStartRamp(t *testing.T) {
+    const window = time.Hour // Long enough for the time spent in the test not to change the ramped weights
+
+    tests := []struct {
+        age     time.Duration // Age of the new endpoint; the other one is known from the start
+        weights []int
+        ramping bool
+    }{
+        {0, []int{1, 200}, true}, // The new endpoint gets the minimal weight but is still picked
+        {window / 2, []int{100, 200}, true},
+        {window, []int{2, 2}, false}, // The targets are returned unchanged when nothing is ramping
+        {2 * window, []int{2, 2}, false},
+    }
+
+    for _, test := range tests {
+        picker, err := NewPicker(PickerConfig{Strategy: RoundRobin, SlowStart: window}, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        targets := []target{
+            {newEndpoint("new", time.Now().Add(-test.age)), 2},
+            {newEndpoint("old", time.Time{}), 2},
+        }
+
+        picker.lock.Lock()
+        ramped := picker.applySlowStart(targets)
+        ramping := picker.rampTimer != nil
+        if ramping {
+            picker.rampTimer.Stop()
+        }
+        picker.lock.Unlock()
+
+        weights := make([]int, len(ramped))
+        for i, t := range ramped {
+            weights[i] = t.weight
+        }
+
+        if !equalInts(weights, test.weights) {
+            t.Errorf("Age %v: expected weights %v, got %v", test.age, test.weights, weights)
+        }
+
+        if ramping != test.ramping {
+            t.Errorf("Age %v: expected ramp update scheduled %v, got %v", test.age, test.ramping, ramping)
+        }
+    }
+}
+
+func TestSlowStartDisabled(t *testing.T) {
+    picker, err := NewPicker(PickerConfig{Strategy: RoundRobin}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    targets := []target{{newEndpoint("new", time.Now()), 2}}
+
+    picker.lock.Lock()
+    ramped := picker.applySlowStart(targets)
+    picker.lock.Unlock()
+
+    if ramped[0].weight != 2 || picker.rampTimer != nil {
+        t.Errorf("Expected the weight to stay unchanged, got %d", ramped[0].weight)
+    }
+}
@@ -0,0 +1,41 @@
+package cycle
+
+// Keeps only the local zone targets while enough of the local zone endpoints are available; must be called under the picker lock
+func (picker *Picker) preferLocalZone(targets []target) []target {
+    zone := picker.config.LocalZone
+    if zone == "" {
+        return targets
+    }
+
+    registered := 0
+    for _, item := range picker.items {
+        if item.Zone == zone && item.Weight > 0 && item.Priority == picker.priority {
+            registered++
+        }
+    }
+
+    localTargets := make([]target, 0, registered)
+    for _, t := range targets {
+        if picker.index[t.endpoint.Host].Zone == zone {
+            localTargets = append(localTargets, t)
+        }
+    }
+
+    spillover := len(localTargets) == 0 || len(localTargets) * 100 < registered * picker.config.ZoneMinHealthy
+
+    if spillover != picker.spillover && picker.logger != nil {
+        if spillover {
+            picker.logger.Printf("Spilling over to other zones: %d of %d endpoints of zone %s are available\n", len(localTargets), registered, zone)
+        } else {
+            picker.logger.Printf("Routing to zone %s only: %d of %d endpoints are available\n", zone, len(localTargets), registered)
+        }
+    }
+
+    picker.spillover = spillover
+
+    if spillover {
+        return targets
+    }
+
+    return localTargets
+}
@@ -1,28 +1,78 @@
 package etcd_utils
 
 import (
+    "encoding/json"
     "fmt"
     etcd_client "github.com/coreos/etcd/client"
     "github.com/maxmanuylov/jongleur/jongleur"
+    "github.com/maxmanuylov/jongleur/utils/cycle"
+    "strings"
     "time"
 )
 
-func NewEtcdItemsLoader(period int, etcdEndpoints []string, loader func (etcd_client.Client) ([]string, error)) (jongleur.ItemsLoader, error) {
-    etcdClient, err := etcd_client.New(etcd_client.Config{
-        Endpoints:               etcdEndpoints,
-        Transport:               etcd_client.DefaultTransport,
-        HeaderTimeoutPerRequest: time.Duration(period) * time.Second / 2,
-    })
+const DefaultItemWeight = 1
 
+type ItemValue struct {
+    Weight     int    `json:"weight"`
+    Zone       string `json:"zone,omitempty"`
+    Priority   int    `json:"priority,omitempty"`
+    ServerName string `json:"server_name,omitempty"`
+}
+
+func NewEtcdItemsLoader(period int, etcdEndpoints []string, loader func (etcd_client.Client) ([]cycle.Item, error)) (jongleur.ItemsLoader, error) {
+    etcdClient, err := NewEtcdClient(period, etcdEndpoints)
     if err != nil {
         return nil, err
     }
 
-    return func() ([]string, error) {
+    return func() ([]cycle.Item, error) {
         return loader(etcdClient)
     }, nil
 }
 
+// Client to share between several items loaders
+func NewEtcdClient(period int, etcdEndpoints []string) (etcd_client.Client, error) {
+    return etcd_client.New(etcd_client.Config{
+        Endpoints:               etcdEndpoints,
+        Transport:               etcd_client.DefaultTransport,
+        HeaderTimeoutPerRequest: time.Duration(period) * time.Second / 2,
+    })
+}
+
 func EtcdItemsKey(itemType string) string {
     return fmt.Sprintf("/jongleur/items/%s", itemType)
-}
\ No newline at end of file
+}
+
+// Item host is a part of the etcd key, so slashes of unix socket paths are escaped
+func EscapeItemHost(host string) string {
+    return strings.NewReplacer("%", "%25", "/", "%2F").Replace(host)
+}
+
+func UnescapeItemHost(escapedHost string) string {
+    return strings.NewReplacer("%2F", "/", "%25", "%").Replace(escapedHost)
+}
+
+func NewItemValue() *ItemValue {
+    return &ItemValue{Weight: DefaultItemWeight}
+}
+
+func (value *ItemValue) Encode() (string, error) {
+    bytes, err := json.Marshal(value)
+    if err != nil {
+        return "", err
+    }
+    return string(bytes), nil
+}
+
+// Values written by the older versions of "jongleur item" as well as malformed values are treated as defaults
+func ParseItemValue(data string) *ItemValue {
+    value := NewItemValue()
+
+    if strings.HasPrefix(data, "{") {
+        if err := json.Unmarshal([]byte(data), value); err != nil {
+            return NewItemValue()
+        }
+    }
+
+    return value
+}
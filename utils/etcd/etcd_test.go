@@ -0,0 +1,36 @@
+package etcd_utils
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestEscapeItemHost(t *testing.T) {
+    tests := []struct {
+        host    string
+        escaped string
+    }{
+        {"1.2.3.4:80", "1.2.3.4:80"},
+        {"[2001:db8::1]:80", "[2001:db8::1]:80"},
+        {"[2001:db8::1]:*", "[2001:db8::1]:*"},
+        {"[fe80::1%eth0]:80", "[fe80::1%25eth0]:80"},
+        {"unix@/run/svc.sock", "unix@%2Frun%2Fsvc.sock"},
+        {"unix@/run/100%2F.sock", "unix@%2Frun%2F100%252F.sock"},
+    }
+
+    for _, test := range tests {
+        escaped := EscapeItemHost(test.host)
+
+        if escaped != test.escaped {
+            t.Errorf("%s: expected %q, got %q", test.host, test.escaped, escaped)
+        }
+
+        if strings.Contains(escaped, "/") {
+            t.Errorf("%s: escaped host %q contains a key separator", test.host, escaped)
+        }
+
+        if host := UnescapeItemHost(escaped); host != test.host {
+            t.Errorf("%s: unescaped back as %q", test.host, host)
+        }
+    }
+}
@@ -7,6 +7,15 @@ import (
     "strings"
 )
 
+// Holders allow config fields to be zero, which is rejected by Check() otherwise
+type StringHolder struct {
+    Value string
+}
+
+type IntHolder struct {
+    Value int
+}
+
 func Check(objectPointer interface{}) error {
     value := reflect.ValueOf(objectPointer).Elem()
     _type := reflect.TypeOf(objectPointer).Elem()
@@ -41,6 +50,10 @@ func ParsePort(portStr string) (int, error) {
     return port, nil
 }
 
+func NewUsageError(message string) UsageError {
+    return UsageError{message: message}
+}
+
 type UsageError struct {
     message string
 }